@@ -0,0 +1,352 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mark-summerfield/gong"
+	"github.com/mark-summerfield/gset"
+	bolt "go.etcd.io/bbolt"
+)
+
+const refsSize = 4 // *must* match blobVal.Refs's size
+
+// A blobs bucket's value, keyed by the SHA256 of the content it holds.
+// Refs is the number of save bucket values that refer to the blob plus the
+// number of delta blobs that use it as their base.
+type blobVal struct {
+	Refs        uint32
+	Compression compression
+	Blob        []byte
+}
+
+func newBlobVal(compression compression, blob []byte) *blobVal {
+	return &blobVal{Refs: 1, Compression: compression, Blob: blob}
+}
+
+func unmarshalBlobVal(raw []byte) *blobVal {
+	return &blobVal{Refs: binary.BigEndian.Uint32(raw[:refsSize]),
+		Compression: compression(raw[refsSize]),
+		Blob:        raw[refsSize+1:]}
+}
+
+func (me *blobVal) marshal() []byte {
+	raw := make([]byte, refsSize, refsSize+1+len(me.Blob))
+	binary.BigEndian.PutUint32(raw, me.Refs)
+	raw = append(raw, byte(me.Compression))
+	return append(raw, me.Blob...)
+}
+
+// String is for Dump() and debugging.
+func (me *blobVal) String() string {
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("%s ", me.Compression))
+	if me.Compression.isDelta() {
+		if deltaVal, err := unmarshalDeltaVal(me.Blob); err == nil {
+			text.WriteString(fmt.Sprintf("%x… ",
+				deltaVal.BaseSha[:4]))
+		}
+	}
+	if me.Compression == chunkedCompression {
+		if chunkedVal, err := unmarshalChunkedVal(me.Blob); err == nil {
+			text.WriteString(fmt.Sprintf("%s chunks %s bytes",
+				gong.Commas(int(chunkedVal.Chunks)),
+				gong.Commas(int(chunkedVal.Size))))
+			return text.String()
+		}
+	}
+	if me.Compression == noCompression && strings.HasPrefix(
+		http.DetectContentType(me.Blob), "text") {
+		text.WriteByte('"')
+		text.WriteString(gong.ElideMiddle(string(me.Blob), 32))
+		text.WriteByte('"')
+	} else {
+		text.WriteString(gong.Commas(len(me.Blob)))
+		text.WriteString(" bytes")
+	}
+	return text.String()
+}
+
+func getBlobs(tx *bolt.Tx) (*bolt.Bucket, error) {
+	blobs := tx.Bucket(blobsBucket)
+	if blobs == nil {
+		return nil, fmt.Errorf("failed to find %q", blobsBucket)
+	}
+	return blobs, nil
+}
+
+func getBlobVal(blobs *bolt.Bucket, sha shA256) *blobVal {
+	rawBlobVal := blobs.Get(sha[:])
+	if rawBlobVal == nil {
+		return nil
+	}
+	return unmarshalBlobVal(rawBlobVal)
+}
+
+// Adds a reference to the blob with the given SHA256 if it exists and
+// returns true; otherwise returns false.
+func addBlobRef(blobs *bolt.Bucket, sha shA256) (bool, error) {
+	blobVal := getBlobVal(blobs, sha)
+	if blobVal == nil {
+		return false, nil
+	}
+	blobVal.Refs++
+	return true, blobs.Put(sha[:], blobVal.marshal())
+}
+
+// Stores the given blob with one reference. The blob must not already
+// exist: use addBlobRef first.
+func putBlob(blobs *bolt.Bucket, sha shA256, blobVal *blobVal) error {
+	return blobs.Put(sha[:], blobVal.marshal())
+}
+
+// Removes a reference to the blob with the given SHA256, deleting the blob
+// if there are no references left. Deleting a delta blob releases its
+// base in turn.
+func releaseBlob(blobs *bolt.Bucket, sha shA256) error {
+	for depth := 0; depth <= maxDeltaChain; depth++ {
+		blobVal := getBlobVal(blobs, sha)
+		if blobVal == nil {
+			return fmt.Errorf("failed to find blob %x", sha)
+		}
+		if blobVal.Refs > 1 {
+			blobVal.Refs--
+			return blobs.Put(sha[:], blobVal.marshal())
+		}
+		if err := blobs.Delete(sha[:]); err != nil {
+			return err
+		}
+		if blobVal.Compression == chunkedCompression {
+			chunks, err := getChunks(blobs.Tx())
+			if err != nil {
+				return err
+			}
+			return deleteChunks(chunks, sha)
+		}
+		if !blobVal.Compression.isDelta() {
+			return nil
+		}
+		deltaVal, err := unmarshalDeltaVal(blobVal.Blob)
+		if err != nil {
+			return err
+		}
+		sha = deltaVal.BaseSha
+	}
+	return fmt.Errorf("delta chain for blob %x is too long", sha)
+}
+
+// Rewrites as a full copy every delta blob whose delta chain passes through
+// one of the given blobs (or through a base that only they lead to and
+// that no save refers to), so that once the given blobs are released none
+// of their content can be rebuilt from the blobs that remain.
+func undeltaBlobs(blobs *bolt.Bucket, shas gset.Set[shA256]) error {
+	bases := make(map[shA256]shA256) // delta blob SHA256 → base SHA256
+	deltaRefs := make(map[shA256]uint32)
+	if err := blobs.ForEach(func(rawSha, rawBlobVal []byte) error {
+		blobVal := unmarshalBlobVal(rawBlobVal)
+		if !blobVal.Compression.isDelta() {
+			return nil
+		}
+		deltaVal, err := unmarshalDeltaVal(blobVal.Blob)
+		if err != nil {
+			return err
+		}
+		bases[shA256(rawSha)] = deltaVal.BaseSha
+		deltaRefs[deltaVal.BaseSha]++
+		return nil
+	}); err != nil {
+		return err
+	}
+	shas = shas.Copy()
+	for _, sha := range shas.ToSlice() {
+		for depth := 0; depth < maxDeltaChain; depth++ {
+			base, ok := bases[sha]
+			if !ok || shas.Contains(base) {
+				break
+			}
+			if blobVal := getBlobVal(blobs, base); blobVal == nil ||
+				blobVal.Refs > deltaRefs[base] {
+				break // a save refers to it so it isn't only theirs
+			}
+			shas.Add(base)
+			sha = base
+		}
+	}
+	for sha := range bases {
+		if passesThrough(bases, sha, shas) {
+			if err := undeltaBlob(blobs, sha); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the given delta blob's chain of bases includes any of
+// the given blobs.
+func passesThrough(bases map[shA256]shA256, sha shA256,
+	shas gset.Set[shA256]) bool {
+	for depth := 0; depth < maxDeltaChain; depth++ {
+		base, ok := bases[sha]
+		if !ok {
+			return false
+		}
+		if shas.Contains(base) {
+			return true
+		}
+		sha = base
+	}
+	return false
+}
+
+// Replaces the given delta blob with a full compressed copy and releases
+// its base (unless releasing an earlier delta blob deleted it).
+func undeltaBlob(blobs *bolt.Bucket, sha shA256) error {
+	oldBlobVal := getBlobVal(blobs, sha)
+	if oldBlobVal == nil || !oldBlobVal.Compression.isDelta() {
+		return nil
+	}
+	deltaVal, err := unmarshalDeltaVal(oldBlobVal.Blob)
+	if err != nil {
+		return err
+	}
+	raw, err := deltaContent(blobs, sha, oldBlobVal, 1)
+	if err != nil {
+		return err
+	}
+	newBlobVal := blobVal{Refs: oldBlobVal.Refs}
+	newBlobVal.Compression, newBlobVal.Blob = compressWith(raw,
+		defaultCodecIds)
+	if err = putBlob(blobs, sha, &newBlobVal); err != nil {
+		return err
+	}
+	return releaseBlob(blobs, deltaVal.BaseSha)
+}
+
+// Writes the uncompressed content of the blob with the given SHA256.
+func writeBlob(blobs *bolt.Bucket, writer io.Writer, sha shA256) error {
+	blobVal := getBlobVal(blobs, sha)
+	if blobVal == nil {
+		return fmt.Errorf("failed to find blob %x", sha)
+	}
+	if blobVal.Compression.isDelta() {
+		raw, err := deltaContent(blobs, sha, blobVal, 1)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(raw)
+		return err
+	}
+	if blobVal.Compression == chunkedCompression {
+		return writeChunks(blobs, writer, sha, blobVal)
+	}
+	return decompress(writer, blobVal.Compression, blobVal.Blob)
+}
+
+// Returns the kind of the blob with the given SHA256's content working from
+// only as much of its content as is needed.
+func blobFileKind(blobs *bolt.Bucket, sha shA256) (fileKind, error) {
+	var head sniffWriter
+	if err := writeBlob(blobs, &head, sha); err != nil &&
+		!errors.Is(err, errSniffed) {
+		return binKind, err
+	}
+	return fileKindForRaw(head.head), nil
+}
+
+// Returns the uncompressed content of the blob with the given SHA256.
+func blobContent(blobs *bolt.Bucket, sha shA256) ([]byte, error) {
+	return blobContentAtDepth(blobs, sha, 1)
+}
+
+func blobContentAtDepth(blobs *bolt.Bucket, sha shA256,
+	depth int) ([]byte, error) {
+	blobVal := getBlobVal(blobs, sha)
+	if blobVal == nil {
+		return nil, fmt.Errorf("failed to find blob %x", sha)
+	}
+	if blobVal.Compression.isDelta() {
+		return deltaContent(blobs, sha, blobVal, depth)
+	}
+	var raw bytes.Buffer
+	var err error
+	if blobVal.Compression == chunkedCompression {
+		err = writeChunks(blobs, &raw, sha, blobVal)
+	} else {
+		err = decompress(&raw, blobVal.Compression, blobVal.Blob)
+	}
+	return raw.Bytes(), err
+}
+
+// Moves every blob out of the save buckets (where format 1 stored them
+// inline after the SHA256 and compression) into the blobs bucket.
+func migrateBlobs(tx *bolt.Tx) error {
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return fmt.Errorf("failed to find %q", savesBucket)
+	}
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return err
+	}
+	rawSids := make([][]byte, 0)
+	cursor := saves.Cursor()
+	rawSid, _ := cursor.First()
+	for ; rawSid != nil; rawSid, _ = cursor.Next() {
+		rawSids = append(rawSids, bytes.Clone(rawSid))
+	}
+	for _, rawSid := range rawSids {
+		if save := saves.Bucket(rawSid); save != nil {
+			if err = migrateSave(save, blobs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateSave(save, blobs *bolt.Bucket) error {
+	rawSaveVals := make(map[string][]byte)
+	err := save.ForEach(func(rawFilename, rawSaveVal []byte) error {
+		rawSaveVals[string(rawFilename)] = bytes.Clone(rawSaveVal)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for filename, rawSaveVal := range rawSaveVals {
+		if err = migrateBlob(save, blobs, []byte(filename),
+			rawSaveVal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateBlob(save, blobs *bolt.Bucket, rawFilename,
+	rawSaveVal []byte) error {
+	if len(rawSaveVal) <= len(shA256{}) {
+		return nil // already migrated
+	}
+	saveVal := unmarshalSaveVal(rawSaveVal)
+	found, err := addBlobRef(blobs, saveVal.Sha)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if err = putBlob(blobs, saveVal.Sha, newBlobVal(
+			compression(rawSaveVal[len(saveVal.Sha)]),
+			rawSaveVal[len(saveVal.Sha)+1:])); err != nil {
+			return err
+		}
+	}
+	return save.Put(rawFilename, saveVal.marshal())
+}
@@ -0,0 +1,540 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mark-summerfield/gong"
+)
+
+const (
+	defaultIdleTimeout = 5 * time.Minute
+
+	// The most content sent in a single Data response.
+	brokerDataSize = 1 << 20
+
+	// Sent by a Client to cancel its call in progress.
+	brokerCancel = "Cancel"
+)
+
+// Errors that keep their identity (for errors.Is) when passed to a Client.
+var brokerErrors = []error{ErrBusy, ErrReadOnly, context.Canceled,
+	context.DeadlineExceeded}
+
+// Broker owns a .fhd file and serves its methods over a Unix domain socket
+// so that any number of processes (e.g., a GUI and command line tools) can
+// use the .fhd file at the same time via Clients. Calls are handled one at
+// a time in the order they arrive. A call is cancelled if its Client
+// cancels it, disconnects, or the Broker is closed. Relative filenames are
+// relative to the .fhd file's folder whatever the Broker's current
+// directory (Clients send absolute ones).
+type Broker struct {
+	fhd         *Fhd
+	ctx         context.Context // Done when the Broker is closed
+	cancel      context.CancelFunc
+	listener    net.Listener
+	socketPath  string
+	idleTimeout time.Duration
+	calling     sync.Mutex // Calls are made one at a time
+	mutex       sync.Mutex // Guards the fields below
+	conns       map[net.Conn]bool
+	idle        *time.Timer
+	closing     bool
+	wg          sync.WaitGroup
+}
+
+// One JSON request per method call.
+type brokerRequest struct {
+	Method   string
+	Args     []json.RawMessage
+	Progress bool // If true, progress responses precede the response
+}
+
+// One JSON response per brokerRequest, preceded by a response with only
+// Progress set for each progress event if the request asked for them, and
+// for Extract and ExtractForSid, by responses with only Data set that
+// hold the content in order. ErrorIs is 1 + the index of the error in
+// brokerErrors that the error wraps, or 0. The Result is sent even if
+// there's an Error since some (e.g., RestoreSnapshot's) are partial.
+type brokerResponse struct {
+	Result   json.RawMessage
+	Error    string
+	ErrorIs  int
+	Progress *ProgressEvent
+	Data     []byte
+}
+
+// Sends what's written to it as Data responses so that content is streamed
+// rather than held in memory.
+type brokerWriter struct {
+	encoder *json.Encoder
+}
+
+func (me brokerWriter) Write(raw []byte) (int, error) {
+	written := 0
+	for written < len(raw) {
+		size := len(raw) - written
+		if size > brokerDataSize {
+			size = brokerDataSize
+		}
+		if err := me.encoder.Encode(brokerResponse{
+			Data: raw[written : written+size]}); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// A Client's error; it wraps the corresponding brokerErrors error if any.
+type brokerError struct {
+	message string
+	err     error
+}
+
+func (me brokerError) Error() string { return me.message }
+
+func (me brokerError) Unwrap() error { return me.err }
+
+// SocketPathForFilename returns the default Unix domain socket path for a
+// Broker serving the given .fhd file: the same file always gets the same
+// path, and different files (or users) get different paths.
+func SocketPathForFilename(filename string) string {
+	sha := sha256.Sum256([]byte(gong.AbsPath(filename)))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("fhd-%d-%x.sock",
+		os.Getuid(), sha[:8]))
+}
+
+// NewBroker opens (and creates if necessary) the given .fhd file and
+// listens on the Unix domain socket ready for Serve. If the .fhd file's
+// lock can't be acquired within the options' Timeout, the error is
+// ErrBusy.
+func NewBroker(filename string, options BrokerOptions) (*Broker, error) {
+	socketPath := options.SocketPath
+	if socketPath == "" {
+		socketPath = SocketPathForFilename(filename)
+	}
+	idleTimeout := options.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	fhd, err := NewWithOptions(filename, Options{Timeout: options.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	// Since we hold the .fhd file's lock, any existing socket is stale.
+	if err = os.Remove(socketPath); err != nil &&
+		!errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.Join(err, fhd.Close())
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.Join(err, fhd.Close())
+	}
+	if err = os.Chmod(socketPath, gong.ModeUserRW); err != nil {
+		return nil, errors.Join(err, listener.Close(), fhd.Close())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Broker{fhd: fhd, ctx: ctx, cancel: cancel, listener: listener,
+		socketPath: socketPath, idleTimeout: idleTimeout,
+		conns: make(map[net.Conn]bool)}, nil
+}
+
+// SocketPath returns the Unix domain socket the Broker listens on.
+func (me *Broker) SocketPath() string {
+	return me.socketPath
+}
+
+// Serve accepts and serves Clients until Close is called or until there
+// have been no Clients for the idle timeout. It then closes the .fhd file
+// and removes the socket.
+func (me *Broker) Serve() error {
+	me.mutex.Lock()
+	me.idle = time.AfterFunc(me.idleTimeout, func() { _ = me.Close() })
+	me.mutex.Unlock()
+	var err error
+	for {
+		conn, aerr := me.listener.Accept()
+		if aerr != nil {
+			me.mutex.Lock()
+			if !me.closing {
+				err = aerr
+			}
+			me.mutex.Unlock()
+			break
+		}
+		me.mutex.Lock()
+		if me.closing {
+			me.mutex.Unlock()
+			_ = conn.Close()
+			break
+		}
+		me.conns[conn] = true
+		me.idle.Stop()
+		me.mutex.Unlock()
+		me.wg.Add(1)
+		go me.serveConn(conn)
+	}
+	_ = me.Close()
+	me.wg.Wait()
+	return errors.Join(err, me.fhd.Close())
+}
+
+// Close stops the Broker: Serve returns once the calls in progress are
+// done.
+func (me *Broker) Close() error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.closing {
+		return nil
+	}
+	me.closing = true
+	me.cancel()
+	if me.idle != nil {
+		me.idle.Stop()
+	}
+	for conn := range me.conns {
+		_ = conn.Close()
+	}
+	return me.listener.Close()
+}
+
+func (me *Broker) serveConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		me.mutex.Lock()
+		delete(me.conns, conn)
+		if len(me.conns) == 0 && !me.closing {
+			me.idle.Reset(me.idleTimeout)
+		}
+		me.mutex.Unlock()
+		me.wg.Done()
+	}()
+	// Requests are read concurrently so that a cancel can arrive while a
+	// call is in progress.
+	requests := make(chan brokerRequest)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(requests)
+		decoder := json.NewDecoder(conn)
+		for {
+			var request brokerRequest
+			if err := decoder.Decode(&request); err != nil {
+				return // Client closed (or sent garbage)
+			}
+			select {
+			case requests <- request:
+			case <-done:
+				return
+			}
+		}
+	}()
+	encoder := json.NewEncoder(conn)
+	for request := range requests {
+		if request.Method == brokerCancel {
+			continue // The call it was for has already finished
+		}
+		response, connected := me.serveRequest(request, requests, encoder)
+		if !connected || encoder.Encode(response) != nil {
+			return
+		}
+	}
+}
+
+// Makes the requested call and returns its response, cancelling the call
+// if a cancel request arrives or the Client disconnects (in which case it
+// returns false). Any progress events and content are sent as they
+// happen (only by the call's goroutine, so the encoder is never shared).
+func (me *Broker) serveRequest(request brokerRequest,
+	requests <-chan brokerRequest, encoder *json.Encoder) (brokerResponse,
+	bool) {
+	ctx, cancel := context.WithCancel(me.ctx)
+	defer cancel()
+	if request.Progress {
+		ctx = WithProgress(ctx, func(event ProgressEvent) {
+			_ = encoder.Encode(brokerResponse{Progress: &event})
+		})
+	}
+	responses := make(chan brokerResponse, 1)
+	go func() {
+		me.calling.Lock()
+		defer me.calling.Unlock()
+		result, err := me.call(ctx, request.Method, request.Args,
+			brokerWriter{encoder})
+		responses <- newBrokerResponse(result, err)
+	}()
+	connected := true
+	for {
+		select {
+		case response := <-responses:
+			return response, connected
+		case next, ok := <-requests:
+			if !ok {
+				connected = false
+				requests = nil // Blocks for ever
+			}
+			if !ok || next.Method == brokerCancel {
+				cancel()
+			}
+		}
+	}
+}
+
+func newBrokerResponse(result any, err error) brokerResponse {
+	var response brokerResponse
+	raw, merr := json.Marshal(result)
+	if merr != nil {
+		err = errors.Join(err, merr)
+	} else {
+		response.Result = raw
+	}
+	if err != nil {
+		response.Error = err.Error()
+		for i, brokerErr := range brokerErrors {
+			if errors.Is(err, brokerErr) {
+				response.ErrorIs = i + 1
+				break
+			}
+		}
+	}
+	return response
+}
+
+// Calls the given method with the given JSON-encoded arguments; methods
+// that can be cancelled are called with the given context, and extracted
+// content is written to output.
+func (me *Broker) call(ctx context.Context, method string,
+	args []json.RawMessage, output io.Writer) (any, error) {
+	var (
+		filename    string
+		filenames   []string
+		comment     string
+		sid         SID
+		sidB        SID
+		flag        bool
+		ignoreItems []IgnoreItem
+	)
+	fhd := me.fhd
+	switch method {
+	case "ReadOnly":
+		return fhd.ReadOnly(), nil
+	case "String":
+		return fhd.String(), nil
+	case "Filename":
+		return fhd.Filename(), nil
+	case "FileFormat":
+		return fhd.FileFormat()
+	case "States":
+		return fhd.States()
+	case "Monitored":
+		return fhd.Monitored()
+	case "MonitorWithComment":
+		if err := unmarshalArgs(args, &comment, &filenames); err != nil {
+			return nil, err
+		}
+		return fhd.MonitorWithCommentContext(ctx, comment, filenames...)
+	case "Unmonitored":
+		return fhd.Unmonitored()
+	case "Unmonitor":
+		if err := unmarshalArgs(args, &filenames); err != nil {
+			return nil, err
+		}
+		return nil, fhd.Unmonitor(filenames...)
+	case "Ignored":
+		return fhd.Ignored()
+	case "Ignore":
+		if err := unmarshalArgs(args, &ignoreItems); err != nil {
+			return nil, err
+		}
+		return nil, fhd.Ignore(ignoreItems...)
+	case "Unignore":
+		if err := unmarshalArgs(args, &filenames); err != nil {
+			return nil, err
+		}
+		return nil, fhd.Unignore(filenames...)
+	case "Unaccounted":
+		return fhd.UnaccountedContext(ctx)
+	case "Status":
+		return fhd.StatusContext(ctx)
+	case "Save":
+		if err := unmarshalArgs(args, &comment); err != nil {
+			return nil, err
+		}
+		return fhd.SaveContext(ctx, comment)
+	case "KeepEmptySaves":
+		return fhd.KeepEmptySaves(), nil
+	case "SetKeepEmptySaves":
+		if err := unmarshalArgs(args, &flag); err != nil {
+			return nil, err
+		}
+		return nil, fhd.SetKeepEmptySaves(flag)
+	case "Paranoid":
+		return fhd.Paranoid(), nil
+	case "SetParanoid":
+		if err := unmarshalArgs(args, &flag); err != nil {
+			return nil, err
+		}
+		return nil, fhd.SetParanoid(flag)
+	case "MaxWorkers":
+		return fhd.MaxWorkers(), nil
+	case "SetMaxWorkers":
+		var workers int
+		if err := unmarshalArgs(args, &workers); err != nil {
+			return nil, err
+		}
+		fhd.SetMaxWorkers(workers)
+		return nil, nil
+	case "ChunkThreshold":
+		return fhd.ChunkThreshold(), nil
+	case "SetChunkThreshold":
+		var threshold int64
+		if err := unmarshalArgs(args, &threshold); err != nil {
+			return nil, err
+		}
+		return nil, fhd.SetChunkThreshold(threshold)
+	case "Codecs":
+		return fhd.Codecs()
+	case "SetCodecs":
+		var ids []byte
+		if err := unmarshalArgs(args, &comment, &ids); err != nil {
+			return nil, err
+		}
+		return nil, fhd.SetCodecs(comment, ids...)
+	case "SaveInfoItemForSid":
+		if err := unmarshalArgs(args, &sid); err != nil {
+			return nil, err
+		}
+		return fhd.SaveInfoItemForSid(sid), nil
+	case "SaveCount":
+		return fhd.SaveCount(), nil
+	case "SaveCountForSid":
+		if err := unmarshalArgs(args, &sid); err != nil {
+			return nil, err
+		}
+		return fhd.SaveCountForSid(sid), nil
+	case "Sid":
+		return fhd.Sid(), nil
+	case "Sids":
+		return fhd.Sids()
+	case "StateForFilename":
+		if err := unmarshalArgs(args, &filename); err != nil {
+			return nil, err
+		}
+		return fhd.StateForFilename(filename)
+	case "SidsForFilename":
+		if err := unmarshalArgs(args, &filename); err != nil {
+			return nil, err
+		}
+		return fhd.SidsForFilename(filename)
+	case "ExtractFile":
+		if err := unmarshalArgs(args, &filename); err != nil {
+			return nil, err
+		}
+		return fhd.ExtractFile(filename)
+	case "ExtractFileForSid":
+		if err := unmarshalArgs(args, &sid, &filename); err != nil {
+			return nil, err
+		}
+		return fhd.ExtractFileForSid(sid, filename)
+	case "Extract":
+		if err := unmarshalArgs(args, &filename); err != nil {
+			return nil, err
+		}
+		return nil, fhd.ExtractContext(ctx, filename, output)
+	case "ExtractForSid":
+		if err := unmarshalArgs(args, &sid, &filename); err != nil {
+			return nil, err
+		}
+		return nil, fhd.ExtractForSidContext(ctx, sid, filename, output)
+	case "Restore":
+		if err := unmarshalArgs(args, &sid, &filename); err != nil {
+			return nil, err
+		}
+		return fhd.RestoreContext(ctx, sid, filename)
+	case "SnapshotSids":
+		if err := unmarshalArgs(args, &sid); err != nil {
+			return nil, err
+		}
+		return fhd.SnapshotSids(sid)
+	case "RestoreSnapshot":
+		if err := unmarshalArgs(args, &sid, &filename,
+			&flag); err != nil {
+			return nil, err
+		}
+		return fhd.RestoreSnapshotContext(ctx, sid, filename, flag)
+	case "Diff":
+		if err := unmarshalArgs(args, &filename, &sid, &sidB); err != nil {
+			return nil, err
+		}
+		return fhd.Diff(filename, sid, sidB)
+	case "DiffWorking":
+		if err := unmarshalArgs(args, &filename, &sid); err != nil {
+			return nil, err
+		}
+		return fhd.DiffWorking(filename, sid)
+	case "Rename":
+		var newFilename string
+		if err := unmarshalArgs(args, &filename,
+			&newFilename); err != nil {
+			return nil, err
+		}
+		return fhd.Rename(filename, newFilename)
+	case "Compact":
+		before, after, err := fhd.CompactContext(ctx)
+		return []int64{before, after}, err
+	case "Recompress":
+		var options RecompressOptions
+		if err := unmarshalArgs(args, &options); err != nil {
+			return nil, err
+		}
+		return fhd.RecompressContext(ctx, options)
+	case "Delete":
+		if err := unmarshalArgs(args, &sid, &filename); err != nil {
+			return nil, err
+		}
+		return nil, fhd.Delete(sid, filename)
+	case "Purge":
+		if err := unmarshalArgs(args, &filename, &flag); err != nil {
+			return nil, err
+		}
+		return nil, fhd.Purge(filename, flag)
+	case "Generation":
+		return fhd.Generation()
+	case "watchSnapshot":
+		return fhd.watchSnapshot()
+	case "DumpTo":
+		var buffer bytes.Buffer
+		err := fhd.DumpTo(&buffer)
+		return buffer.String(), err
+	}
+	return nil, fmt.Errorf("invalid broker method %q", method)
+}
+
+// Unmarshals each JSON-encoded argument into the corresponding target.
+func unmarshalArgs(args []json.RawMessage, targets ...any) error {
+	if len(args) != len(targets) {
+		return fmt.Errorf("expected %d arguments, got %d", len(targets),
+			len(args))
+	}
+	for i, arg := range args {
+		if err := json.Unmarshal(arg, targets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
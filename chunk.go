@@ -0,0 +1,283 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	chunkSize             = 1 << 22 // 4MB
+	chunkIndexSize        = 4       // *must* match chunkKey's index size
+	defaultChunkThreshold = 1 << 26 // 64MB
+)
+
+// A chunked blob's Blob holds the number of chunks and the total
+// uncompressed size. The chunks themselves are in the chunks bucket, keyed
+// by the blob's SHA256 followed by the chunk's 0-based index, and each
+// chunk's value is its compression followed by its (possibly compressed)
+// content. This means that large files can be saved and extracted without
+// ever holding more than a chunk or so in memory.
+type chunkedVal struct {
+	Chunks uint32
+	Size   int64
+}
+
+func unmarshalChunkedVal(raw []byte) (chunkedVal, error) {
+	if len(raw) != 12 {
+		return chunkedVal{}, errors.New("invalid chunked blob")
+	}
+	return chunkedVal{Chunks: binary.BigEndian.Uint32(raw),
+		Size: int64(binary.BigEndian.Uint64(raw[4:]))}, nil
+}
+
+func (me chunkedVal) marshal() []byte {
+	raw := binary.BigEndian.AppendUint32(make([]byte, 0, 12), me.Chunks)
+	return binary.BigEndian.AppendUint64(raw, uint64(me.Size))
+}
+
+func chunkKey(sha shA256, index uint32) []byte {
+	return binary.BigEndian.AppendUint32(append(make([]byte, 0,
+		len(sha)+chunkIndexSize), sha[:]...), index)
+}
+
+func getChunks(tx *bolt.Tx) (*bolt.Bucket, error) {
+	chunks := tx.Bucket(chunksBucket)
+	if chunks == nil {
+		return nil, fmt.Errorf("failed to find %q", chunksBucket)
+	}
+	return chunks, nil
+}
+
+// Returns the size at or above which files are stored in chunks.
+func getChunkThreshold(tx *bolt.Tx) int64 {
+	if config := tx.Bucket(configBucket); config != nil {
+		if raw := config.Get(configChunkThreshold); len(raw) == 8 {
+			return int64(binary.BigEndian.Uint64(raw))
+		}
+	}
+	return defaultChunkThreshold
+}
+
+// Streams the given file into chunks stored under the given SHA256 using
+// transactions of bounded size and returns the chunked blobVal to store.
+// (Each chunk is compressed with the best of the given codecs.) It is an
+// error if the file's content no longer has the given SHA256. On error the
+// chunks stored so far are left for the save to delete (see
+// deleteOrphanChunks) since another of its files may have the same
+// content.
+func (me *Fhd) putChunks(ctx context.Context, filename string, sha shA256,
+	ids []byte) (*blobVal, error) {
+	file, err := os.Open(me.diskPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	buffer := make([]byte, chunkSize)
+	pending := make([][]byte, 0)
+	pendingSize := 0
+	var chunkedVal chunkedVal
+	flush := func() error {
+		first := chunkedVal.Chunks - uint32(len(pending))
+		err := me.updateChunks(func(tx *bolt.Tx) error {
+			chunks, err := getChunks(tx)
+			if err != nil {
+				return err
+			}
+			for i, chunk := range pending {
+				if err = chunks.Put(chunkKey(sha, first+uint32(i)),
+					chunk); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		pending = pending[:0]
+		pendingSize = 0
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		size, err := io.ReadFull(file, buffer)
+		if size > 0 {
+			hasher.Write(buffer[:size])
+			compression, blob := compressWith(buffer[:size], ids)
+			pending = append(pending, append([]byte{byte(compression)},
+				blob...))
+			pendingSize += len(blob)
+			chunkedVal.Chunks++
+			chunkedVal.Size += int64(size)
+			if pendingSize >= compactTxMaxSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = flush(); err != nil {
+		return nil, err
+	}
+	if shA256(hasher.Sum(nil)) != sha {
+		return nil, fmt.Errorf("%s changed while being saved", filename)
+	}
+	return newBlobVal(chunkedCompression, chunkedVal.marshal()), nil
+}
+
+// Writes the content of the given chunked blob one chunk at a time and
+// checks that the result has the expected SHA256.
+func writeChunks(blobs *bolt.Bucket, writer io.Writer, sha shA256,
+	blobVal *blobVal) error {
+	chunkedVal, err := unmarshalChunkedVal(blobVal.Blob)
+	if err != nil {
+		return err
+	}
+	chunks, err := getChunks(blobs.Tx())
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	writer = io.MultiWriter(writer, hasher)
+	for index := uint32(0); index < chunkedVal.Chunks; index++ {
+		chunk := chunks.Get(chunkKey(sha, index))
+		if len(chunk) == 0 {
+			return fmt.Errorf("failed to find chunk %d of blob %x", index,
+				sha)
+		}
+		if err = decompress(writer, compression(chunk[0]),
+			chunk[1:]); err != nil {
+			return err
+		}
+	}
+	if shA256(hasher.Sum(nil)) != sha {
+		return fmt.Errorf("rebuilt blob %x has the wrong SHA256", sha)
+	}
+	return nil
+}
+
+// Returns the number of bytes the chunks stored under the given SHA256
+// occupy.
+func chunksSize(tx *bolt.Tx, sha shA256) int64 {
+	var size int64
+	if chunks := tx.Bucket(chunksBucket); chunks != nil {
+		cursor := chunks.Cursor()
+		key, chunk := cursor.Seek(sha[:])
+		for ; key != nil && bytes.HasPrefix(key, sha[:]); key,
+			chunk = cursor.Next() {
+			size += int64(len(chunk))
+		}
+	}
+	return size
+}
+
+// Deletes every chunk stored under the given SHA256.
+func deleteChunks(chunks *bolt.Bucket, sha shA256) error {
+	keys := make([][]byte, 0)
+	cursor := chunks.Cursor()
+	key, _ := cursor.Seek(sha[:])
+	for ; key != nil && bytes.HasPrefix(key, sha[:]); key, _ = cursor.Next() {
+		keys = append(keys, bytes.Clone(key))
+	}
+	for _, key := range keys {
+		if err := chunks.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the chunks of any of the given files that were stored (or
+// partly stored) in chunks if no blob refers to them (e.g., because the
+// save failed).
+func (me *Fhd) deleteOrphanChunks(prepared []*preparedFile) error {
+	shas := make([]shA256, 0)
+	for _, file := range prepared {
+		if file.chunked {
+			shas = append(shas, file.sha)
+		}
+	}
+	if len(shas) == 0 {
+		return nil
+	}
+	return me.updateChunks(func(tx *bolt.Tx) error {
+		var err error
+		for _, sha := range shas {
+			if ierr := deleteUnusedChunks(tx, sha); ierr != nil {
+				err = errors.Join(err, ierr)
+			}
+		}
+		return err
+	})
+}
+
+// Deletes every chunk that no blob refers to, e.g., because the process
+// died after a save stored its chunks but before the save was committed.
+func sweepChunks(tx *bolt.Tx) error {
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return err
+	}
+	chunks, err := getChunks(tx)
+	if err != nil {
+		return err
+	}
+	orphans := make([]shA256, 0)
+	cursor := chunks.Cursor()
+	key, _ := cursor.First()
+	for key != nil {
+		if len(key) < sha256.Size {
+			return fmt.Errorf("invalid chunk key %x", key)
+		}
+		sha := shA256(key[:sha256.Size])
+		if getBlobVal(blobs, sha) == nil {
+			orphans = append(orphans, sha)
+		}
+		// Skip the rest of this SHA256's chunks
+		key, _ = cursor.Seek(chunkKey(sha, math.MaxUint32))
+		if key != nil && bytes.HasPrefix(key, sha[:]) {
+			key, _ = cursor.Next()
+		}
+	}
+	for _, sha := range orphans {
+		if ierr := deleteChunks(chunks, sha); ierr != nil {
+			err = errors.Join(err, ierr)
+		}
+	}
+	return err
+}
+
+// Deletes the chunks stored under the given SHA256 if no blob refers to
+// them.
+func deleteUnusedChunks(tx *bolt.Tx, sha shA256) error {
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return err
+	}
+	if getBlobVal(blobs, sha) != nil {
+		return nil
+	}
+	chunks, err := getChunks(tx)
+	if err != nil {
+		return err
+	}
+	return deleteChunks(chunks, sha)
+}
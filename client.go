@@ -0,0 +1,587 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/mark-summerfield/gong"
+	"github.com/mark-summerfield/gset"
+)
+
+// Client uses a .fhd file via a Broker and has the same methods as Fhd.
+// Methods that don't return an error return the zero value if the Broker
+// can't be reached. Errors keep their identity for errors.Is only for
+// ErrBusy, ErrReadOnly, context.Canceled, and context.DeadlineExceeded.
+// Relative filenames are relative to the current directory (they're sent
+// to the Broker as absolute paths).
+type Client struct {
+	conn     net.Conn
+	encoder  *json.Encoder
+	decoder  *json.Decoder
+	mutex    sync.Mutex // Calls are made one at a time
+	progress func(ProgressEvent)
+}
+
+// NewClient connects to the Broker listening on the given Unix domain
+// socket (see SocketPathForFilename).
+func NewClient(socketPath string) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn)}, nil
+}
+
+// Returns the given filenames as absolute paths since the Broker's current
+// directory may differ from the Client's.
+func absPaths(filenames []string) []string {
+	paths := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		paths = append(paths, gong.AbsPath(filename))
+	}
+	return paths
+}
+
+// Calls the given method on the Broker's Fhd and unmarshals its result
+// into result unless result is nil.
+func (me *Client) call(result any, method string, args ...any) error {
+	return me.callContext(context.Background(), result, method, args...)
+}
+
+// Like call, but if the context is done before the Broker responds, the
+// call is cancelled and ctx.Err() is returned (unless the call finished
+// anyway).
+func (me *Client) callContext(ctx context.Context, result any,
+	method string, args ...any) error {
+	return me.callOutput(ctx, result, nil, method, args...)
+}
+
+// Like callContext, but any content the Broker sends is written to output:
+// if that fails, the call is cancelled and the write's error is returned.
+func (me *Client) callOutput(ctx context.Context, result any,
+	output io.Writer, method string, args ...any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var outputErr error
+	data := func(raw []byte) {
+		if outputErr == nil && output != nil {
+			if _, outputErr = output.Write(raw); outputErr != nil {
+				cancel()
+			}
+		}
+	}
+	progress := progressFor(ctx, me.progress)
+	request := brokerRequest{Method: method,
+		Args:     make([]json.RawMessage, 0, len(args)),
+		Progress: progress != nil}
+	for _, arg := range args {
+		raw, err := json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+		request.Args = append(request.Args, raw)
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if err := me.encoder.Encode(request); err != nil {
+		return err
+	}
+	var response brokerResponse
+	if err := me.receive(ctx, &response, progress, data); err != nil {
+		return err
+	}
+	if outputErr != nil {
+		return outputErr
+	}
+	if response.Error != "" {
+		if result != nil && len(response.Result) > 0 {
+			_ = json.Unmarshal(response.Result, result) // partial result
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := brokerError{message: response.Error}
+		if response.ErrorIs > 0 && response.ErrorIs <= len(brokerErrors) {
+			err.err = brokerErrors[response.ErrorIs-1]
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// Reads the Broker's response (passing any progress and data responses
+// that precede it to progress and data), sending a cancel request if the
+// context is done first: me.mutex must be locked.
+func (me *Client) receive(ctx context.Context, response *brokerResponse,
+	progress func(ProgressEvent), data func([]byte)) error {
+	decode := func() error {
+		for {
+			*response = brokerResponse{}
+			if err := me.decoder.Decode(response); err != nil {
+				return err
+			}
+			switch {
+			case response.Data != nil:
+				data(response.Data)
+			case response.Progress != nil:
+				if progress != nil {
+					progress(*response.Progress)
+				}
+			default:
+				return nil
+			}
+		}
+	}
+	if ctx.Done() == nil {
+		return decode()
+	}
+	received := make(chan error, 1)
+	go func() { received <- decode() }()
+	select {
+	case err := <-received:
+		return err
+	case <-ctx.Done():
+		if err := me.encoder.Encode(brokerRequest{
+			Method: brokerCancel}); err != nil {
+			return errors.Join(err, me.conn.Close())
+		}
+		return <-received
+	}
+}
+
+// ReadOnly returns true if the Broker's .fhd file was opened read-only.
+func (me *Client) ReadOnly() bool {
+	var readOnly bool
+	_ = me.call(&readOnly, "ReadOnly")
+	return readOnly
+}
+
+// Close disconnects from the Broker (which keeps the .fhd file open).
+func (me *Client) Close() error {
+	return me.conn.Close()
+}
+
+func (me *Client) String() string {
+	var text string
+	_ = me.call(&text, "String")
+	return text
+}
+
+// Filename returns the Broker's .fhd file's filename.
+func (me *Client) Filename() string {
+	var filename string
+	_ = me.call(&filename, "Filename")
+	return filename
+}
+
+// See Fhd.FileFormat.
+func (me *Client) FileFormat() (int, error) {
+	var fileFormat int
+	err := me.call(&fileFormat, "FileFormat")
+	return fileFormat, err
+}
+
+// See Fhd.States.
+func (me *Client) States() ([]*StateItem, error) {
+	var stateItems []*StateItem
+	err := me.call(&stateItems, "States")
+	return stateItems, err
+}
+
+// See Fhd.Monitored.
+func (me *Client) Monitored() ([]*StateItem, error) {
+	var stateItems []*StateItem
+	err := me.call(&stateItems, "Monitored")
+	return stateItems, err
+}
+
+// See Fhd.Monitor.
+func (me *Client) Monitor(filenames ...string) (SaveResult, error) {
+	return me.MonitorWithComment("", filenames...)
+}
+
+// See Fhd.MonitorWithComment.
+func (me *Client) MonitorWithComment(comment string,
+	filenames ...string) (SaveResult, error) {
+	return me.MonitorWithCommentContext(context.Background(), comment,
+		filenames...)
+}
+
+// See Fhd.MonitorContext.
+func (me *Client) MonitorContext(ctx context.Context,
+	filenames ...string) (SaveResult, error) {
+	return me.MonitorWithCommentContext(ctx, "", filenames...)
+}
+
+// See Fhd.MonitorWithCommentContext.
+func (me *Client) MonitorWithCommentContext(ctx context.Context,
+	comment string, filenames ...string) (SaveResult, error) {
+	var saveResult SaveResult
+	err := me.callContext(ctx, &saveResult, "MonitorWithComment", comment,
+		absPaths(filenames))
+	return saveResult, err
+}
+
+// See Fhd.Unmonitored.
+func (me *Client) Unmonitored() ([]*StateItem, error) {
+	var stateItems []*StateItem
+	err := me.call(&stateItems, "Unmonitored")
+	return stateItems, err
+}
+
+// See Fhd.Unmonitor.
+func (me *Client) Unmonitor(filenames ...string) error {
+	return me.call(nil, "Unmonitor", absPaths(filenames))
+}
+
+// See Fhd.Ignored.
+func (me *Client) Ignored() ([]IgnoreItem, error) {
+	var ignoreItems []IgnoreItem
+	err := me.call(&ignoreItems, "Ignored")
+	return ignoreItems, err
+}
+
+// See Fhd.Ignore.
+func (me *Client) Ignore(ignoreItems ...IgnoreItem) error {
+	return me.call(nil, "Ignore", ignoreItems)
+}
+
+// See Fhd.Unignore.
+func (me *Client) Unignore(patterns ...string) error {
+	return me.call(nil, "Unignore", patterns)
+}
+
+// See Fhd.Unaccounted.
+func (me *Client) Unaccounted() (gset.Set[string], error) {
+	return me.UnaccountedContext(context.Background())
+}
+
+// See Fhd.UnaccountedContext.
+func (me *Client) UnaccountedContext(ctx context.Context) (gset.Set[string],
+	error) {
+	unaccounted := gset.New[string]()
+	err := me.callContext(ctx, &unaccounted, "Unaccounted")
+	return unaccounted, err
+}
+
+// See Fhd.Status.
+func (me *Client) Status() ([]*StatusItem, error) {
+	return me.StatusContext(context.Background())
+}
+
+// See Fhd.StatusContext.
+func (me *Client) StatusContext(ctx context.Context) ([]*StatusItem,
+	error) {
+	var statusItems []*StatusItem
+	err := me.callContext(ctx, &statusItems, "Status")
+	return statusItems, err
+}
+
+// See Fhd.Save.
+func (me *Client) Save(comment string) (SaveResult, error) {
+	return me.SaveContext(context.Background(), comment)
+}
+
+// See Fhd.SaveContext.
+func (me *Client) SaveContext(ctx context.Context,
+	comment string) (SaveResult, error) {
+	var saveResult SaveResult
+	err := me.callContext(ctx, &saveResult, "Save", comment)
+	return saveResult, err
+}
+
+// See Fhd.KeepEmptySaves.
+func (me *Client) KeepEmptySaves() bool {
+	var keep bool
+	_ = me.call(&keep, "KeepEmptySaves")
+	return keep
+}
+
+// See Fhd.SetKeepEmptySaves.
+func (me *Client) SetKeepEmptySaves(keep bool) error {
+	return me.call(nil, "SetKeepEmptySaves", keep)
+}
+
+// See Fhd.Paranoid.
+func (me *Client) Paranoid() bool {
+	var paranoid bool
+	_ = me.call(&paranoid, "Paranoid")
+	return paranoid
+}
+
+// See Fhd.SetParanoid.
+func (me *Client) SetParanoid(paranoid bool) error {
+	return me.call(nil, "SetParanoid", paranoid)
+}
+
+// See Fhd.MaxWorkers.
+func (me *Client) MaxWorkers() int {
+	var workers int
+	_ = me.call(&workers, "MaxWorkers")
+	return workers
+}
+
+// See Fhd.SetMaxWorkers.
+func (me *Client) SetMaxWorkers(workers int) {
+	_ = me.call(nil, "SetMaxWorkers", workers)
+}
+
+// See Fhd.ChunkThreshold.
+func (me *Client) ChunkThreshold() int64 {
+	var threshold int64
+	_ = me.call(&threshold, "ChunkThreshold")
+	return threshold
+}
+
+// See Fhd.SetChunkThreshold.
+func (me *Client) SetChunkThreshold(threshold int64) error {
+	return me.call(nil, "SetChunkThreshold", threshold)
+}
+
+// See Fhd.Codecs.
+func (me *Client) Codecs() (map[string][]byte, error) {
+	var codecIds map[string][]byte
+	err := me.call(&codecIds, "Codecs")
+	return codecIds, err
+}
+
+// See Fhd.SetCodecs.
+func (me *Client) SetCodecs(pattern string, ids ...byte) error {
+	return me.call(nil, "SetCodecs", pattern, ids)
+}
+
+// See Fhd.SaveInfoItemForSid.
+func (me *Client) SaveInfoItemForSid(sid SID) SaveInfoItem {
+	var saveInfoItem SaveInfoItem
+	_ = me.call(&saveInfoItem, "SaveInfoItemForSid", sid)
+	return saveInfoItem
+}
+
+// See Fhd.SaveCount.
+func (me *Client) SaveCount() int {
+	var count int
+	_ = me.call(&count, "SaveCount")
+	return count
+}
+
+// See Fhd.SaveCountForSid.
+func (me *Client) SaveCountForSid(sid SID) int {
+	var count int
+	_ = me.call(&count, "SaveCountForSid", sid)
+	return count
+}
+
+// See Fhd.Sid.
+func (me *Client) Sid() SID {
+	var sid SID
+	_ = me.call(&sid, "Sid")
+	return sid
+}
+
+// See Fhd.Sids.
+func (me *Client) Sids() ([]SID, error) {
+	var sids []SID
+	err := me.call(&sids, "Sids")
+	return sids, err
+}
+
+// See Fhd.StateForFilename.
+func (me *Client) StateForFilename(filename string) (StateVal, error) {
+	var stateVal StateVal
+	err := me.call(&stateVal, "StateForFilename", gong.AbsPath(filename))
+	return stateVal, err
+}
+
+// See Fhd.SidsForFilename.
+func (me *Client) SidsForFilename(filename string) ([]SID, error) {
+	var sids []SID
+	err := me.call(&sids, "SidsForFilename", gong.AbsPath(filename))
+	return sids, err
+}
+
+// See Fhd.ExtractFile. (The new filename is relative to the .fhd file's
+// folder.)
+func (me *Client) ExtractFile(filename string) (string, error) {
+	var extracted string
+	err := me.call(&extracted, "ExtractFile", gong.AbsPath(filename))
+	return extracted, err
+}
+
+// See Fhd.ExtractFileForSid. (The new filename is relative to the .fhd
+// file's folder.)
+func (me *Client) ExtractFileForSid(sid SID, filename string) (string,
+	error) {
+	var extracted string
+	err := me.call(&extracted, "ExtractFileForSid", sid,
+		gong.AbsPath(filename))
+	return extracted, err
+}
+
+// See Fhd.Extract.
+func (me *Client) Extract(filename string, writer io.Writer) error {
+	return me.ExtractContext(context.Background(), filename, writer)
+}
+
+// See Fhd.ExtractContext.
+func (me *Client) ExtractContext(ctx context.Context, filename string,
+	writer io.Writer) error {
+	return me.callOutput(ctx, nil, writer, "Extract", gong.AbsPath(filename))
+}
+
+// See Fhd.ExtractForSid.
+func (me *Client) ExtractForSid(sid SID, filename string,
+	writer io.Writer) error {
+	return me.ExtractForSidContext(context.Background(), sid, filename,
+		writer)
+}
+
+// See Fhd.ExtractForSidContext.
+func (me *Client) ExtractForSidContext(ctx context.Context, sid SID,
+	filename string, writer io.Writer) error {
+	return me.callOutput(ctx, nil, writer, "ExtractForSid", sid,
+		gong.AbsPath(filename))
+}
+
+// See Fhd.Restore.
+func (me *Client) Restore(sid SID, filename string) (SaveResult, error) {
+	return me.RestoreContext(context.Background(), sid, filename)
+}
+
+// See Fhd.RestoreContext.
+func (me *Client) RestoreContext(ctx context.Context, sid SID,
+	filename string) (SaveResult, error) {
+	var saveResult SaveResult
+	err := me.callContext(ctx, &saveResult, "Restore", sid,
+		gong.AbsPath(filename))
+	return saveResult, err
+}
+
+// See Fhd.SnapshotSids.
+func (me *Client) SnapshotSids(sid SID) (map[string]SID, error) {
+	var sids map[string]SID
+	err := me.call(&sids, "SnapshotSids", sid)
+	return sids, err
+}
+
+// See Fhd.RestoreSnapshot.
+func (me *Client) RestoreSnapshot(sid SID, destDir string,
+	overwrite bool) ([]string, error) {
+	return me.RestoreSnapshotContext(context.Background(), sid, destDir,
+		overwrite)
+}
+
+// See Fhd.RestoreSnapshotContext.
+func (me *Client) RestoreSnapshotContext(ctx context.Context, sid SID,
+	destDir string, overwrite bool) ([]string, error) {
+	var filenames []string
+	err := me.callContext(ctx, &filenames, "RestoreSnapshot", sid,
+		gong.AbsPath(destDir), overwrite)
+	return filenames, err
+}
+
+// See Fhd.Diff.
+func (me *Client) Diff(filename string, sidA, sidB SID) (*Diff, error) {
+	var diff *Diff
+	err := me.call(&diff, "Diff", gong.AbsPath(filename), sidA, sidB)
+	return diff, err
+}
+
+// See Fhd.DiffWorking.
+func (me *Client) DiffWorking(filename string, sid SID) (*Diff, error) {
+	var diff *Diff
+	err := me.call(&diff, "DiffWorking", gong.AbsPath(filename), sid)
+	return diff, err
+}
+
+// See Fhd.Rename.
+func (me *Client) Rename(oldFilename, newFilename string) (SaveResult,
+	error) {
+	var saveResult SaveResult
+	err := me.call(&saveResult, "Rename", gong.AbsPath(oldFilename),
+		gong.AbsPath(newFilename))
+	return saveResult, err
+}
+
+// See Fhd.Compact.
+func (me *Client) Compact() (int64, int64, error) {
+	return me.CompactContext(context.Background())
+}
+
+// See Fhd.CompactContext.
+func (me *Client) CompactContext(ctx context.Context) (int64, int64,
+	error) {
+	var sizes [2]int64 // before, after
+	err := me.callContext(ctx, &sizes, "Compact")
+	return sizes[0], sizes[1], err
+}
+
+// See Fhd.Recompress. (The options' Progress function isn't called.)
+func (me *Client) Recompress(options RecompressOptions) (RecompressResult,
+	error) {
+	return me.RecompressContext(context.Background(), options)
+}
+
+// See Fhd.RecompressContext. (The options' Progress function isn't
+// called.)
+func (me *Client) RecompressContext(ctx context.Context,
+	options RecompressOptions) (RecompressResult, error) {
+	var result RecompressResult
+	err := me.callContext(ctx, &result, "Recompress", options)
+	return result, err
+}
+
+// See Fhd.Delete.
+func (me *Client) Delete(sid SID, filename string) error {
+	return me.call(nil, "Delete", sid, gong.AbsPath(filename))
+}
+
+// See Fhd.Purge.
+func (me *Client) Purge(filename string, compact bool) error {
+	return me.call(nil, "Purge", gong.AbsPath(filename), compact)
+}
+
+// See Fhd.Dump.
+func (me *Client) Dump() error {
+	return me.DumpTo(os.Stderr)
+}
+
+// See Fhd.DumpTo.
+func (me *Client) DumpTo(writer io.Writer) error {
+	var text string
+	if err := me.call(&text, "DumpTo"); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, text)
+	return err
+}
+
+// See Fhd.Generation.
+func (me *Client) Generation() (uint64, error) {
+	var generation uint64
+	err := me.call(&generation, "Generation")
+	return generation, err
+}
+
+// See Fhd.Watch.
+func (me *Client) Watch(ctx context.Context) (<-chan WatchEvent, error) {
+	return watch(ctx, me.Filename(), func() (watchSnapshot, error) {
+		var snapshot watchSnapshot
+		err := me.call(&snapshot, "watchSnapshot")
+		return snapshot, err
+	})
+}
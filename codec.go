@@ -0,0 +1,145 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"compress/flate"
+	"compress/lzw"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The Ids of the built-in codecs.
+const (
+	CodecNone  = 'U'
+	CodecFlate = 'F'
+	CodecLzw   = 'L'
+)
+
+// Codec compresses and decompresses file content. Every blob records the
+// Id of the codec that compressed it, so a custom codec must be registered
+// with RegisterCodec before any .fhd file that uses it is opened.
+type Codec interface {
+	Id() byte
+	NewWriter(writer io.Writer) (io.WriteCloser, error)
+	NewReader(reader io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[byte]Codec{CodecNone: noCodec{},
+		CodecFlate: flateCodec{}, CodecLzw: lzwCodec{}}
+
+	// Files that match no codecs pattern are tried with each of these.
+	defaultCodecIds = []byte{CodecFlate, CodecLzw}
+)
+
+// RegisterCodec adds the given codec to the registry. It is an error to
+// register a codec whose Id is already registered or is used for deltas or
+// chunks.
+func RegisterCodec(codec Codec) error {
+	id := codec.Id()
+	if compression(id).isReserved() {
+		return fmt.Errorf("codec Id %q is reserved", id)
+	}
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if _, ok := codecs[id]; ok {
+		return fmt.Errorf("codec Id %q is already registered", id)
+	}
+	codecs[id] = codec
+	return nil
+}
+
+// CodecForId returns the registered codec with the given Id or nil.
+func CodecForId(id byte) Codec {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	return codecs[id]
+}
+
+type noCodec struct{}
+
+func (me noCodec) Id() byte { return CodecNone }
+
+func (me noCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{writer}, nil
+}
+
+func (me noCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(reader), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (me nopWriteCloser) Close() error { return nil }
+
+type flateCodec struct{}
+
+func (me flateCodec) Id() byte { return CodecFlate }
+
+func (me flateCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(writer, 9)
+}
+
+func (me flateCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(reader), nil
+}
+
+type lzwCodec struct{}
+
+func (me lzwCodec) Id() byte { return CodecLzw }
+
+func (me lzwCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return lzw.NewWriter(writer, lzw.MSB, 8), nil
+}
+
+func (me lzwCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return lzw.NewReader(reader, lzw.MSB, 8), nil
+}
+
+func getCodecs(tx *bolt.Tx) *bolt.Bucket {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return nil
+	}
+	return config.Bucket(configCodecs)
+}
+
+// Returns the Ids of the codecs to try for the given filename: those of
+// the first (in pattern order) glob that matches the filename's basename
+// (or the whole filename if the glob contains a separator), or the default
+// codecs if none matches.
+func codecIdsForFilename(codecs *bolt.Bucket, filename string) []byte {
+	if codecs != nil {
+		cursor := codecs.Cursor()
+		rawPattern, ids := cursor.First()
+		for ; rawPattern != nil; rawPattern, ids = cursor.Next() {
+			if (IgnoreItem{Pattern: string(rawPattern),
+				IgnoreKind: IgnoreGlob}).matches(filename) {
+				return ids
+			}
+		}
+	}
+	return defaultCodecIds
+}
+
+// Validates and stores the codec Ids for the given glob.
+func putCodecIds(codecs *bolt.Bucket, pattern string, ids []byte) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid codecs pattern %q: %s", pattern, err)
+	}
+	for _, id := range ids {
+		if CodecForId(id) == nil {
+			return fmt.Errorf("unregistered codec Id %q", id)
+		}
+	}
+	return codecs.Put([]byte(pattern), ids)
+}
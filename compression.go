@@ -3,30 +3,118 @@
 
 package fhd
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
 const (
-	noCompression    compression = 'U'
-	flateCompression compression = 'F'
-	lzwCompression   compression = 'L'
+	noCompression    compression = CodecNone
+	flateCompression compression = CodecFlate
+	lzwCompression   compression = CodecLzw
+	// Deltas: see deltaVal
+	deltaCompression       compression = 'D'
+	binaryDeltaCompression compression = 'V'
+	// Large files: see chunkedVal
+	chunkedCompression compression = 'C'
 )
 
+// A compression is the Id of the Codec used to compress a blob, or says
+// that the blob is a delta or is stored in chunks.
 type compression byte
 
 func (me compression) String() string {
 	return string(me)
 }
 
-func compressionForSizes(rawSize, flateSize, lzwSize int) compression {
+func (me compression) isDelta() bool {
+	return me == deltaCompression || me == binaryDeltaCompression
+}
+
+// Returns true if the compression isn't a codec's.
+func (me compression) isReserved() bool {
+	return me.isDelta() || me == chunkedCompression
+}
+
+// Returns the compression with the smallest size (the first wins ties), or
+// noCompression if none saves at least 5%. A size of 0 means the
+// compression failed.
+func compressionForCandidates(rawSize int, compressions []compression,
+	sizes []int) compression {
 	maxSize := int(float64(rawSize) * 0.95)
-	if (flateSize > maxSize && lzwSize > maxSize) || (flateSize == 0 &&
-		lzwSize == 0) {
-		return noCompression
+	best := noCompression
+	bestSize := maxSize
+	for i, size := range sizes {
+		if size > 0 && size < bestSize {
+			best = compressions[i]
+			bestSize = size
+		}
+	}
+	return best
+}
+
+// Compresses raw with each of the given codecs concurrently and returns the
+// best compression and its blob.
+func compressWith(raw []byte, ids []byte) (compression, []byte) {
+	compressions := make([]compression, 0, len(ids))
+	blobs := make([]bytes.Buffer, len(ids))
+	sizes := make([]int, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		compressions = append(compressions, compression(id))
+		if id == CodecNone {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, codec Codec) {
+			defer wg.Done()
+			if err := compressTo(&blobs[i], codec, raw); err == nil {
+				sizes[i] = blobs[i].Len()
+			}
+		}(i, CodecForId(id))
+	}
+	wg.Wait()
+	best := compressionForCandidates(len(raw), compressions, sizes)
+	for i, compression := range compressions {
+		if compression == best && sizes[i] > 0 {
+			return best, blobs[i].Bytes()
+		}
+	}
+	return noCompression, raw
+}
+
+func compressTo(buffer *bytes.Buffer, codec Codec, raw []byte) error {
+	if codec == nil {
+		return errors.New("unregistered codec")
+	}
+	writer, err := codec.NewWriter(buffer)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(raw)
+	if ierr := writer.Close(); ierr != nil {
+		err = errors.Join(err, ierr)
+	}
+	return err
+}
+
+// Writes the decompressed blob using the registered codec.
+func decompress(writer io.Writer, compression compression,
+	blob []byte) error {
+	codec := CodecForId(byte(compression))
+	if codec == nil {
+		return fmt.Errorf("invalid compression %v", compression)
 	}
-	if flateSize > 0 && flateSize < maxSize && (lzwSize == 0 ||
-		(lzwSize > 0 && flateSize < lzwSize)) {
-		return flateCompression
+	reader, err := codec.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return err
 	}
-	if lzwSize > 0 && lzwSize < maxSize {
-		return lzwCompression
+	_, err = io.Copy(writer, reader)
+	if ierr := reader.Close(); ierr != nil {
+		err = errors.Join(err, ierr)
 	}
-	return noCompression
+	return err
 }
@@ -3,26 +3,68 @@
 
 package fhd
 
-import _ "embed"
+import (
+	_ "embed"
+	"errors"
+)
+
+const (
+	compactSuffix         = ".$$$"
+	compactTxMaxSize      = 1 << 26 // commit every 64MB when compacting
+	restoreComment        = "before restore"
+	configTrue       byte = 'Y'
+	configFalse      byte = 'N'
+)
 
 var (
 	//go:embed Version.dat
 	Version string
 
-	fileFormat byte = 1
-
-	configBucket   = []byte("config")
-	statesBucket   = []byte("states")
-	saveInfoBucket = []byte("saveinfo")
-	savesBucket    = []byte("saves")
-	configFormat   = []byte("format")
-	configIgnore   = []byte("ignore")
-	emptyValue     = []byte{}
-
-	// Should also ignore hidden (.) files and subdirs by default.
-	defaultIgnores = []string{"*#[0-9].*", "*.a", "*.bak", "*.class",
-		"*.dll", "*.exe", "*.fhd", "*.jar", "*.ld", "*.ldx", "*.li",
-		"*.lix", "*.o", "*.obj", "*.py[co]", "*.rs.bk", "*.so", "*.sw[nop]",
-		"*.swp", "*.tmp", "*~", "gpl-[0-9].[0-9].txt", "louti[0-9]*",
-		"moc_*.cpp", "qrc_*.cpp", "ui_*.h"}
+	fileFormat byte = 2
+
+	configBucket         = []byte("config")
+	statesBucket         = []byte("states")
+	saveInfoBucket       = []byte("saveinfo")
+	savesBucket          = []byte("saves")
+	blobsBucket          = []byte("blobs")
+	statsBucket          = []byte("stats")
+	chunksBucket         = []byte("chunks")
+	historyBucket        = []byte("history")
+	configFormat         = []byte("format")
+	configIgnore         = []byte("ignore")
+	configKeepEmpty      = []byte("keepempty")
+	configCodecs         = []byte("codecs")
+	configParanoid       = []byte("paranoid")
+	configChunkThreshold = []byte("chunkthreshold")
+	configGeneration     = []byte("generation")
+	// The highest SID ever used so that purged saves' SIDs aren't reused
+	configLastSid = []byte("lastsid")
+	// The SHA256 of the last blob recompressed if Recompress is unfinished
+	configRecompress = []byte("recompress")
+
+	errNoChanges = errors.New("no changes")
+	errSniffed   = errors.New("sniffed")
+
+	// ErrBusy is returned if the .fhd file is locked by another process
+	// for longer than the Options' Timeout.
+	ErrBusy = errors.New("the .fhd file is in use")
+
+	// ErrReadOnly is returned by methods that would change a .fhd file
+	// that was opened read-only.
+	ErrReadOnly = errors.New("the .fhd file is open read-only")
+
+	// Hidden (.) files and subdirs are ignored by default too. (".?*" is
+	// used for subdirs since ".*" is already the key of the hidden files'
+	// glob; the two are equivalent since "." and ".." are never matched.)
+	defaultDirIgnores = []string{".?*"}
+	defaultIgnores    = []string{".*", "*#[0-9].*", "*.a", "*.bak",
+		"*.class", "*.dll", "*.exe", "*.fhd", "*.jar", "*.ld", "*.ldx",
+		"*.li", "*.lix", "*.o", "*.obj", "*.py[co]", "*.rs.bk", "*.so",
+		"*.sw[nop]", "*.swp", "*.tmp", "*~", "gpl-[0-9].[0-9].txt",
+		"louti[0-9]*", "moc_*.cpp", "qrc_*.cpp", "ui_*.h"}
+
+	// Files that are already compressed aren't compressed again.
+	defaultUncompressed = []string{"*.7z", "*.bz2", "*.docx", "*.gif",
+		"*.gz", "*.jpeg", "*.jpg", "*.mp3", "*.mp4", "*.odp", "*.ods",
+		"*.odt", "*.png", "*.pptx", "*.webp", "*.xlsx", "*.xz", "*.zip"}
 )
@@ -0,0 +1,324 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A delta is a sequence of instructions which rebuild content from a base:
+// deltaCopy is followed by a uvarint offset and uvarint length of bytes to
+// copy from the base; deltaInsert is followed by a uvarint length and that
+// many bytes to insert.
+const (
+	deltaCopy   byte = 'C'
+	deltaInsert byte = 'I'
+
+	// Deltas are only ever made against bases that are fewer than this
+	// many deltas away from a full copy, so rebuilding any version needs
+	// at most this many deltas to be applied.
+	maxDeltaChain = 16
+
+	// Binary deltas match blocks of this many bytes; they're only used if
+	// they're at most 1/binaryDeltaRatio the size of a full copy.
+	binaryDeltaBlockSize = 32
+	binaryDeltaRatio     = 2
+	rollingHashPrime     = 16777619
+)
+
+// A delta blob's Blob holds the SHA256 of its base blob, the compression of
+// the delta, and the (possibly compressed) delta itself.
+type deltaVal struct {
+	BaseSha     shA256
+	Compression compression
+	Delta       []byte
+}
+
+func unmarshalDeltaVal(raw []byte) (*deltaVal, error) {
+	if len(raw) < sha256.Size+1 {
+		return nil, errors.New("invalid delta")
+	}
+	return &deltaVal{BaseSha: shA256(raw[:sha256.Size]),
+		Compression: compression(raw[sha256.Size]),
+		Delta:       raw[sha256.Size+1:]}, nil
+}
+
+func (me *deltaVal) marshal() []byte {
+	raw := make([]byte, 0, sha256.Size+1+len(me.Delta))
+	raw = append(raw, me.BaseSha[:]...)
+	raw = append(raw, byte(me.Compression))
+	return append(raw, me.Delta...)
+}
+
+type deltaWriter struct {
+	delta   bytes.Buffer
+	pending []byte // consecutive inserts are combined
+}
+
+func (me *deltaWriter) copy(offset, length int) {
+	if length == 0 {
+		return
+	}
+	me.flush()
+	me.delta.WriteByte(deltaCopy)
+	me.delta.Write(binary.AppendUvarint(nil, uint64(offset)))
+	me.delta.Write(binary.AppendUvarint(nil, uint64(length)))
+}
+
+func (me *deltaWriter) insert(raw []byte) {
+	me.pending = append(me.pending, raw...)
+}
+
+func (me *deltaWriter) flush() {
+	if len(me.pending) > 0 {
+		me.delta.WriteByte(deltaInsert)
+		me.delta.Write(binary.AppendUvarint(nil, uint64(len(me.pending))))
+		me.delta.Write(me.pending)
+		me.pending = me.pending[:0]
+	}
+}
+
+func (me *deltaWriter) bytes() []byte {
+	me.flush()
+	return me.delta.Bytes()
+}
+
+// Returns a delta which rebuilds raw from base working line by line, or
+// false if the delta can't be less than maxSize. Leaving aside
+// compression, every inserted line adds at least a byte to the delta, and
+// the number of deletes is the number of inserts plus the difference in
+// line counts, so the diff is given up on once it needs more than maxSize
+// inserts.
+func textDelta(base, raw []byte, maxSize int) ([]byte, bool) {
+	aLines := splitLines(base)
+	bLines := splitLines(raw)
+	hunks, ok := diffLinesWithin(aLines, bLines,
+		2*maxSize+len(aLines)-len(bLines))
+	if !ok {
+		return nil, false
+	}
+	offsets := make([]int, 0, len(aLines)+1)
+	offset := 0
+	for _, line := range aLines {
+		offsets = append(offsets, offset)
+		offset += len(line)
+	}
+	offsets = append(offsets, offset)
+	var delta deltaWriter
+	for _, hunk := range hunks {
+		switch hunk.Kind {
+		case DiffEqual:
+			delta.copy(offsets[hunk.AStart],
+				offsets[hunk.AEnd]-offsets[hunk.AStart])
+		case DiffInsert:
+			for _, line := range bLines[hunk.BStart:hunk.BEnd] {
+				delta.insert([]byte(line))
+			}
+		}
+	}
+	return delta.bytes(), true
+}
+
+// Returns a delta which rebuilds raw from base by finding blocks of raw in
+// base using a rolling hash.
+func binaryDelta(base, raw []byte) []byte {
+	var delta deltaWriter
+	if len(base) < binaryDeltaBlockSize || len(raw) < binaryDeltaBlockSize {
+		delta.insert(raw)
+		return delta.bytes()
+	}
+	blocks := make(map[uint32]int, len(base)/binaryDeltaBlockSize)
+	for offset := 0; offset+binaryDeltaBlockSize <= len(base); offset +=
+		binaryDeltaBlockSize {
+		hash := rollingHash(base[offset : offset+binaryDeltaBlockSize])
+		if _, ok := blocks[hash]; !ok {
+			blocks[hash] = offset
+		}
+	}
+	outFactor := uint32(1) // rollingHashPrime ** (binaryDeltaBlockSize-1)
+	for i := 1; i < binaryDeltaBlockSize; i++ {
+		outFactor *= rollingHashPrime
+	}
+	start := 0 // raw[start:i] is pending insertion
+	i := 0
+	hash := rollingHash(raw[:binaryDeltaBlockSize])
+	for i+binaryDeltaBlockSize <= len(raw) {
+		if offset, ok := blocks[hash]; ok && bytes.Equal(
+			base[offset:offset+binaryDeltaBlockSize],
+			raw[i:i+binaryDeltaBlockSize]) {
+			for offset > 0 && i > start && base[offset-1] == raw[i-1] {
+				offset--
+				i--
+			}
+			end := i + binaryDeltaBlockSize
+			for offset+end-i < len(base) && end < len(raw) &&
+				base[offset+end-i] == raw[end] {
+				end++
+			}
+			delta.insert(raw[start:i])
+			delta.copy(offset, end-i)
+			start, i = end, end
+			if i+binaryDeltaBlockSize <= len(raw) {
+				hash = rollingHash(raw[i : i+binaryDeltaBlockSize])
+			}
+			continue
+		}
+		if i+binaryDeltaBlockSize < len(raw) {
+			hash = (hash-uint32(raw[i])*outFactor)*rollingHashPrime +
+				uint32(raw[i+binaryDeltaBlockSize])
+		}
+		i++
+	}
+	delta.insert(raw[start:])
+	return delta.bytes()
+}
+
+func rollingHash(block []byte) uint32 {
+	var hash uint32
+	for _, b := range block {
+		hash = hash*rollingHashPrime + uint32(b)
+	}
+	return hash
+}
+
+func applyDelta(base, delta []byte) ([]byte, error) {
+	reader := bytes.NewReader(delta)
+	raw := make([]byte, 0, len(base))
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return raw, nil
+		}
+		switch op {
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			if offset+length > uint64(len(base)) {
+				return nil, fmt.Errorf("invalid delta copy %d:%d of %d",
+					offset, length, len(base))
+			}
+			raw = append(raw, base[offset:offset+length]...)
+		case deltaInsert:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			if length > uint64(reader.Len()) {
+				return nil, fmt.Errorf("invalid delta insert %d of %d",
+					length, reader.Len())
+			}
+			start := len(raw)
+			raw = append(raw, make([]byte, length)...)
+			if _, err = io.ReadFull(reader, raw[start:]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid delta op %q", op)
+		}
+	}
+}
+
+// Returns a delta blobVal for raw against the blob with the given base
+// SHA256, or nil if the base is missing, is already at the end of a
+// maximum length chain of deltas, or if the delta's size isn't less than
+// maxSize. Text is only ever delta'd against a text base.
+func deltaBlobVal(blobs *bolt.Bucket, baseSha shA256, raw []byte,
+	kind fileKind, maxSize int) (*blobVal, error) {
+	if deltaDepth(blobs, baseSha) >= maxDeltaChain-1 {
+		return nil, nil // store a full copy so the chain starts afresh
+	}
+	if baseBlobVal := getBlobVal(blobs, baseSha); baseBlobVal == nil ||
+		baseBlobVal.Compression == chunkedCompression {
+		return nil, nil // chunked blobs are too big to delta against
+	}
+	base, err := blobContent(blobs, baseSha)
+	if err != nil {
+		return nil, err
+	}
+	var delta []byte
+	deltaKind := deltaCompression
+	if kind == txtKind {
+		if fileKindForRaw(base) != txtKind {
+			return nil, nil
+		}
+		var ok bool
+		if delta, ok = textDelta(base, raw, maxSize); !ok {
+			return nil, nil
+		}
+	} else {
+		deltaKind = binaryDeltaCompression
+		maxSize /= binaryDeltaRatio
+		delta = binaryDelta(base, raw)
+	}
+	compression, delta := compressWith(delta, defaultCodecIds)
+	deltaVal := &deltaVal{BaseSha: baseSha, Compression: compression,
+		Delta: delta}
+	rawDeltaVal := deltaVal.marshal()
+	if len(rawDeltaVal) >= maxSize {
+		return nil, nil
+	}
+	return newBlobVal(deltaKind, rawDeltaVal), nil
+}
+
+// Returns the number of deltas that must be applied to rebuild the
+// content of the blob with the given SHA256.
+func deltaDepth(blobs *bolt.Bucket, sha shA256) int {
+	depth := 0
+	for depth <= maxDeltaChain {
+		blobVal := getBlobVal(blobs, sha)
+		if blobVal == nil || !blobVal.Compression.isDelta() {
+			break
+		}
+		deltaVal, err := unmarshalDeltaVal(blobVal.Blob)
+		if err != nil {
+			break
+		}
+		depth++
+		sha = deltaVal.BaseSha
+	}
+	return depth
+}
+
+// Rebuilds the content of the given delta blob by applying its delta to its
+// base's content, and checks that the result has the expected SHA256.
+func deltaContent(blobs *bolt.Bucket, sha shA256, blobVal *blobVal,
+	depth int) ([]byte, error) {
+	if depth > maxDeltaChain {
+		return nil, fmt.Errorf("delta chain for blob %x is too long", sha)
+	}
+	deltaVal, err := unmarshalDeltaVal(blobVal.Blob)
+	if err != nil {
+		return nil, err
+	}
+	base, err := blobContentAtDepth(blobs, deltaVal.BaseSha, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	var delta bytes.Buffer
+	if err = decompress(&delta, deltaVal.Compression,
+		deltaVal.Delta); err != nil {
+		return nil, err
+	}
+	raw, err := applyDelta(base, delta.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if shA256(sha256.Sum256(raw)) != sha {
+		return nil, fmt.Errorf("rebuilt blob %x has the wrong SHA256", sha)
+	}
+	return raw, nil
+}
@@ -0,0 +1,397 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DiffEqual  DiffKind = '='
+	DiffInsert DiffKind = '+'
+	DiffDelete DiffKind = '-'
+)
+
+type DiffKind byte
+
+func (me DiffKind) String() string {
+	return string(me)
+}
+
+// DiffHunk is a run of lines that are equal in both versions, inserted
+// into the second version, or deleted from the first version. The ranges
+// are half-open 0-based line indexes into Diff.ALines and Diff.BLines.
+type DiffHunk struct {
+	Kind   DiffKind
+	AStart int
+	AEnd   int
+	BStart int
+	BEnd   int
+}
+
+func (me DiffHunk) String() string {
+	return fmt.Sprintf("%s%d:%d/%d:%d", me.Kind, me.AStart, me.AEnd,
+		me.BStart, me.BEnd)
+}
+
+// Diff holds the differences between two versions of a text file. Each
+// line includes its line ending (if any). If SidB is InvalidSID the second
+// version is the file's current content on disk.
+type Diff struct {
+	Filename string
+	SidA     SID
+	SidB     SID
+	ALines   []string
+	BLines   []string
+	Hunks    []DiffHunk
+}
+
+func newDiff(filename string, sidA, sidB SID, a, b []byte) *Diff {
+	diff := &Diff{Filename: filename, SidA: sidA, SidB: sidB,
+		ALines: splitLines(a), BLines: splitLines(b)}
+	diff.Hunks = diffLines(diff.ALines, diff.BLines)
+	return diff
+}
+
+// IsSame returns true if the two versions have the same content.
+func (me *Diff) IsSame() bool {
+	for _, hunk := range me.Hunks {
+		if hunk.Kind != DiffEqual {
+			return false
+		}
+	}
+	return true
+}
+
+// Unified returns the differences in unified diff format with the given
+// number of lines of context, or "" if the versions are the same.
+func (me *Diff) Unified(context int) string {
+	if me.IsSame() {
+		return ""
+	}
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("--- %s#%d\n", me.Filename, me.SidA))
+	if me.SidB.IsValid() {
+		text.WriteString(fmt.Sprintf("+++ %s#%d\n", me.Filename, me.SidB))
+	} else {
+		text.WriteString(fmt.Sprintf("+++ %s\n", me.Filename))
+	}
+	lineOps := me.lineOps()
+	for _, group := range groupLineOps(lineOps, context) {
+		me.writeUnifiedGroup(&text, lineOps[group.start:group.end])
+	}
+	return text.String()
+}
+
+func (me *Diff) writeUnifiedGroup(text *strings.Builder, lineOps []lineOp) {
+	aCount, bCount := 0, 0
+	for _, op := range lineOps {
+		if op.kind != DiffInsert {
+			aCount++
+		}
+		if op.kind != DiffDelete {
+			bCount++
+		}
+	}
+	text.WriteString(fmt.Sprintf("@@ -%s +%s @@\n",
+		unifiedRange(lineOps[0].a, aCount),
+		unifiedRange(lineOps[0].b, bCount)))
+	for _, op := range lineOps {
+		var line string
+		switch op.kind {
+		case DiffEqual:
+			line = " " + me.ALines[op.a]
+		case DiffDelete:
+			line = "-" + me.ALines[op.a]
+		case DiffInsert:
+			line = "+" + me.BLines[op.b]
+		}
+		text.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			text.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func unifiedRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// A single line's part in a diff: a and b are the line's indexes in ALines
+// and BLines (for inserts a is where the line goes; for deletes b is).
+type lineOp struct {
+	kind DiffKind
+	a    int
+	b    int
+}
+
+func (me *Diff) lineOps() []lineOp {
+	lineOps := make([]lineOp, 0, len(me.ALines)+len(me.BLines))
+	for _, hunk := range me.Hunks {
+		switch hunk.Kind {
+		case DiffEqual:
+			for i := 0; i < hunk.AEnd-hunk.AStart; i++ {
+				lineOps = append(lineOps, lineOp{DiffEqual, hunk.AStart + i,
+					hunk.BStart + i})
+			}
+		case DiffDelete:
+			for a := hunk.AStart; a < hunk.AEnd; a++ {
+				lineOps = append(lineOps, lineOp{DiffDelete, a,
+					hunk.BStart})
+			}
+		case DiffInsert:
+			for b := hunk.BStart; b < hunk.BEnd; b++ {
+				lineOps = append(lineOps, lineOp{DiffInsert, hunk.AStart,
+					b})
+			}
+		}
+	}
+	return lineOps
+}
+
+type span struct {
+	start int
+	end   int
+}
+
+// Returns the spans of lineOps to output as unified diff hunks: each
+// span has one or more changes and up to context equal lines either side.
+func groupLineOps(lineOps []lineOp, context int) []span {
+	groups := make([]span, 0)
+	i := 0
+	for i < len(lineOps) {
+		for i < len(lineOps) && lineOps[i].kind == DiffEqual {
+			i++
+		}
+		if i == len(lineOps) {
+			break
+		}
+		group := span{start: i - context}
+		if group.start < 0 {
+			group.start = 0
+		}
+		lastChange := i
+		for i < len(lineOps) {
+			if lineOps[i].kind != DiffEqual {
+				lastChange = i
+			} else if i-lastChange > 2*context {
+				break
+			}
+			i++
+		}
+		group.end = lastChange + 1 + context
+		if group.end > len(lineOps) {
+			group.end = len(lineOps)
+		}
+		i = group.end
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Splits text into lines each keeping its "\n" (the last might not have
+// one).
+func splitLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns the hunks needed to turn a into b.
+func diffLines(a, b []string) []DiffHunk {
+	hunks, _ := diffLinesWithin(a, b, len(a)+len(b))
+	return hunks
+}
+
+// Returns the hunks needed to turn a into b using the linear space version
+// of Myers' O(ND) algorithm after trimming any common prefix and suffix, or
+// false if that needs more than maxD line inserts and deletes.
+func diffLinesWithin(a, b []string, maxD int) ([]DiffHunk, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops, ok := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix],
+		maxD)
+	if !ok {
+		return nil, false
+	}
+	hunks := make([]DiffHunk, 0)
+	add := func(kind DiffKind, a, b int) {
+		aEnd, bEnd := a, b
+		if kind != DiffInsert {
+			aEnd++
+		}
+		if kind != DiffDelete {
+			bEnd++
+		}
+		if n := len(hunks) - 1; n >= 0 && hunks[n].Kind == kind &&
+			hunks[n].AEnd == a && hunks[n].BEnd == b {
+			hunks[n].AEnd = aEnd
+			hunks[n].BEnd = bEnd
+		} else {
+			hunks = append(hunks, DiffHunk{Kind: kind, AStart: a,
+				AEnd: aEnd, BStart: b, BEnd: bEnd})
+		}
+	}
+	for i := 0; i < prefix; i++ {
+		add(DiffEqual, i, i)
+	}
+	for _, op := range ops {
+		add(op.kind, op.a+prefix, op.b+prefix)
+	}
+	for i := suffix; i > 0; i-- {
+		add(DiffEqual, len(a)-i, len(b)-i)
+	}
+	return hunks, true
+}
+
+// Finds the line operations for the linear space version of Myers'
+// algorithm: the forward and reverse furthest reaching paths are only ever
+// needed for one (sub)problem at a time, so they're allocated once.
+type myersDiffer struct {
+	a       []string
+	b       []string
+	forward []int
+	reverse []int
+	ops     []lineOp
+}
+
+// Returns the line operations that turn a into b, or false if that needs
+// more than maxD inserts and deletes.
+func myers(a, b []string, maxD int) ([]lineOp, bool) {
+	size := len(a) + len(b) + 2
+	differ := &myersDiffer{a: a, b: b, forward: make([]int, 2*size+1),
+		reverse: make([]int, 2*size+1),
+		ops:     make([]lineOp, 0, len(a)+len(b))}
+	if len(a) > 0 && len(b) > 0 {
+		// Only the top-level problem can exceed maxD: its subproblems'
+		// distances add up to its own.
+		if _, _, _, _, d := differ.middleSnake(0, len(a), 0, len(b),
+			maxD); d < 0 {
+			return nil, false
+		}
+	} else if len(a)+len(b) > maxD {
+		return nil, false
+	}
+	differ.diff(0, len(a), 0, len(b))
+	return differ.ops, true
+}
+
+// Appends the line operations that turn a[aLo:aHi] into b[bLo:bHi].
+func (me *myersDiffer) diff(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && me.a[aLo] == me.b[bLo] {
+		me.ops = append(me.ops, lineOp{DiffEqual, aLo, bLo})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix &&
+		me.a[aHi-1-suffix] == me.b[bHi-1-suffix] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
+	switch {
+	case aLo == aHi:
+		for b := bLo; b < bHi; b++ {
+			me.ops = append(me.ops, lineOp{DiffInsert, aLo, b})
+		}
+	case bLo == bHi:
+		for a := aLo; a < aHi; a++ {
+			me.ops = append(me.ops, lineOp{DiffDelete, a, bLo})
+		}
+	default:
+		// Since neither end matches, the distance is at least 2, so
+		// both halves are smaller problems.
+		x, y, u, v, _ := me.middleSnake(aLo, aHi, bLo, bHi, aHi-aLo+bHi-bLo)
+		me.diff(aLo, x, bLo, y)
+		for ; x < u; x, y = x+1, y+1 {
+			me.ops = append(me.ops, lineOp{DiffEqual, x, y})
+		}
+		me.diff(u, aHi, v, bHi)
+	}
+	for i := suffix; i > 0; i-- {
+		me.ops = append(me.ops, lineOp{DiffEqual, aHi + suffix - i,
+			bHi + suffix - i})
+	}
+}
+
+// Returns the middle snake (x, y) to (u, v) of a shortest path from
+// (aLo, bLo) to (aHi, bHi) and the path's length d, or a d of -1 if d
+// would be more than maxD.
+func (me *myersDiffer) middleSnake(aLo, aHi, bLo, bHi,
+	maxD int) (x, y, u, v, d int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	offset := (len(me.forward) - 1) / 2
+	me.forward[offset+1] = 0
+	me.reverse[offset+1] = 0
+	for d = 0; d <= (n+m+1)/2; d++ {
+		if 2*d-1 > maxD {
+			break
+		}
+		// Forward paths on diagonals k = x - y
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d &&
+				me.forward[offset+k-1] < me.forward[offset+k+1]) {
+				x = me.forward[offset+k+1]
+			} else {
+				x = me.forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && me.a[aLo+u] == me.b[bLo+v] {
+				u++
+				v++
+			}
+			me.forward[offset+k] = u
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 &&
+				u+me.reverse[offset+c] >= n {
+				return aLo + x, bLo + y, aLo + u, bLo + v, 2*d - 1
+			}
+		}
+		if 2*d > maxD {
+			break
+		}
+		// Reverse paths on diagonals c = (n - x) - (m - y)
+		for c := -d; c <= d; c += 2 {
+			var rx int
+			if c == -d || (c != d &&
+				me.reverse[offset+c-1] < me.reverse[offset+c+1]) {
+				rx = me.reverse[offset+c+1]
+			} else {
+				rx = me.reverse[offset+c-1] + 1
+			}
+			ry := rx - c
+			ru, rv := rx, ry
+			for ru < n && rv < m &&
+				me.a[aHi-1-ru] == me.b[bHi-1-rv] {
+				ru++
+				rv++
+			}
+			me.reverse[offset+c] = ru
+			if k := delta - c; !odd && k >= -d && k <= d &&
+				ru+me.forward[offset+k] >= n {
+				return aHi - ru, bHi - rv, aHi - rx, bHi - ry, 2 * d
+			}
+		}
+	}
+	return 0, 0, 0, 0, -1
+}
@@ -26,7 +26,7 @@ func (me *Fhd) Dump() error {
 func (me *Fhd) DumpTo(writer io.Writer) error {
 	write := func(text string) { _, _ = writer.Write([]byte(text)) }
 	writeRaw := func(raw []byte) { _, _ = writer.Write(raw) }
-	return me.db.View(func(tx *bolt.Tx) error {
+	return me.view(func(tx *bolt.Tx) error {
 		dumpConfig(tx, write, writeRaw)
 		dumpStates(tx, write, writeRaw)
 		return dumpSaves(tx, write, writeRaw)
@@ -52,14 +52,22 @@ func dumpConfig(tx *bolt.Tx, write writeStr, writeRaw writeRaw) {
 		} else {
 			write("  ignore=")
 			cursor := ignore.Cursor()
-			rawFilename, _ := cursor.First()
-			for ; rawFilename != nil; rawFilename, _ = cursor.Next() {
-				write(" \"")
-				writeRaw(rawFilename)
-				write("\"")
+			rawPattern, rawIgnoreKind := cursor.First()
+			for ; rawPattern != nil; rawPattern,
+				rawIgnoreKind = cursor.Next() {
+				write(" " + newIgnoreItemFromRaw(rawPattern,
+					rawIgnoreKind).String())
 			}
 			write("\n")
 		}
+		if codecs := config.Bucket(configCodecs); codecs != nil {
+			write("  codecs=")
+			_ = codecs.ForEach(func(rawPattern, ids []byte) error {
+				write(fmt.Sprintf(" %q%s", rawPattern, ids))
+				return nil
+			})
+			write("\n")
+		}
 	}
 }
 
@@ -97,7 +105,8 @@ func dumpSaves(tx *bolt.Tx, write writeStr, writeRaw writeRaw) error {
 				writeRaw); err != nil {
 				return err
 			}
-			if err := dumpSave(saves, rawSid, write, writeRaw); err != nil {
+			if err := dumpSave(tx, saves, rawSid, write,
+				writeRaw); err != nil {
 				return err
 			}
 		}
@@ -131,25 +140,34 @@ func dumpSaveItem(tx *bolt.Tx, rawSid []byte, write writeStr,
 	return nil
 }
 
-func dumpSave(saves *bolt.Bucket, rawSid []byte, write writeStr,
-	writeRaw writeRaw) error {
+func dumpSave(tx *bolt.Tx, saves *bolt.Bucket, rawSid []byte,
+	write writeStr, writeRaw writeRaw) error {
 	save := saves.Bucket(rawSid)
 	if save == nil {
 		write("error: missing save\n")
 	} else {
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
+		}
 		cursor := save.Cursor()
 		rawFilename, rawSaveVal := cursor.First()
 		for ; rawFilename != nil; rawFilename, rawSaveVal = cursor.Next() {
-			dumpSaveVal(rawFilename, rawSaveVal, write, writeRaw)
+			dumpSaveVal(blobs, rawFilename, rawSaveVal, write, writeRaw)
 		}
 	}
 	return nil
 }
 
-func dumpSaveVal(rawFilename []byte, rawSaveVal []byte, write writeStr,
-	writeRaw writeRaw) {
+func dumpSaveVal(blobs *bolt.Bucket, rawFilename []byte, rawSaveVal []byte,
+	write writeStr, writeRaw writeRaw) {
 	write("    ")
 	writeRaw(rawFilename)
 	saveVal := unmarshalSaveVal(rawSaveVal)
+	if blobVal := getBlobVal(blobs, saveVal.Sha); blobVal == nil {
+		write(" error (blob is missing)")
+	} else {
+		write(" " + blobVal.String())
+	}
 	write(" " + saveVal.String() + "\n")
 }
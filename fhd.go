@@ -5,49 +5,71 @@ package fhd
 
 import (
 	"bytes"
-	"compress/flate"
-	"compress/lzw"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/mark-summerfield/gong"
+	"github.com/mark-summerfield/gset"
 	bolt "go.etcd.io/bbolt"
 )
 
 type Fhd struct {
-	db *bolt.DB
+	db         *bolt.DB
+	dbLock     sync.RWMutex // Compact closes and reopens db
+	filename   string
+	options    Options
+	saving     sync.Mutex // Saves are done one at a time
+	maxWorkers int
 }
 
 // New opens (and creates if necessary) the given .fhd file ready for use.
 func New(filename string) (*Fhd, error) {
-	db, err := newDb(gong.AbsPath(filename))
+	return NewWithOptions(filename, Options{})
+}
+
+// NewWithOptions opens (and unless read-only, creates if necessary) the
+// given .fhd file ready for use. If the .fhd file's lock can't be acquired
+// within the options' Timeout, the error is ErrBusy.
+func NewWithOptions(filename string, options Options) (*Fhd, error) {
+	filename = gong.AbsPath(filename)
+	db, err := newDb(filename, options)
 	if err != nil {
 		return nil, err
 	}
-	return &Fhd{db: db}, nil
+	return &Fhd{db: db, filename: filename, options: options}, nil
+}
+
+// ReadOnly returns true if the .fhd file was opened read-only.
+func (me *Fhd) ReadOnly() bool {
+	return me.options.ReadOnly
 }
 
 // Close closes the underlying database.
 func (me *Fhd) Close() error {
+	me.dbLock.Lock()
+	defer me.dbLock.Unlock()
 	return me.db.Close()
 }
 
 func (me *Fhd) String() string {
 	format, _ := me.FileFormat()
-	return fmt.Sprintf("<Fhd filename=%q format=%d>", me.db.Path(), format)
+	return fmt.Sprintf("<Fhd filename=%q format=%d>", me.filename, format)
 }
 
 // Filename returns the underlying database's filename.
 func (me *Fhd) Filename() string {
-	return me.db.Path()
+	return me.filename
 }
 
 // Format returns the underlying database's file format number.
 func (me *Fhd) FileFormat() (int, error) {
 	var fileformat byte
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		format := tx.Bucket(configBucket).Get(configFormat)
 		if len(format) == 1 {
 			fileformat = format[0]
@@ -66,7 +88,7 @@ func (me *Fhd) FileFormat() (int, error) {
 // file and the SID of the last save it was saved into.
 func (me *Fhd) States() ([]*StateItem, error) {
 	stateItem := make([]*StateItem, 0)
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		states := tx.Bucket(statesBucket)
 		if states == nil {
 			return fmt.Errorf("failed to find %q", statesBucket)
@@ -100,11 +122,29 @@ func (me *Fhd) Monitor(filenames ...string) (SaveResult, error) {
 // sets of missing and ignored files (which aren't monitored).
 func (me *Fhd) MonitorWithComment(comment string,
 	filenames ...string) (SaveResult, error) {
-	missing, ignored, err := me.monitor(filenames...)
+	return me.MonitorWithCommentContext(context.Background(), comment,
+		filenames...)
+}
+
+// MonitorContext is like Monitor but can be cancelled (see SaveContext).
+func (me *Fhd) MonitorContext(ctx context.Context,
+	filenames ...string) (SaveResult, error) {
+	return me.MonitorWithCommentContext(ctx, "", filenames...)
+}
+
+// MonitorWithCommentContext is like MonitorWithComment but can be
+// cancelled (see SaveContext). If it is cancelled during the save, the
+// files stay monitored and are saved by the next Save.
+func (me *Fhd) MonitorWithCommentContext(ctx context.Context,
+	comment string, filenames ...string) (SaveResult, error) {
+	if err := ctx.Err(); err != nil {
+		return newInvalidSaveResult(), err
+	}
+	missing, ignored, changed, err := me.monitor(filenames...)
 	if err != nil {
 		return newInvalidSaveResult(), err
 	}
-	return me.save(comment, missing, ignored)
+	return me.save(ctx, comment, missing, ignored, changed)
 }
 
 // Unmonitored returns the list of every unmonitored file.
@@ -118,7 +158,7 @@ func (me *Fhd) Unmonitored() ([]*StateItem, error) {
 // being monitored and preserves its SID. For any file that isn't already
 // monitored, adds it to the ignored list.
 func (me *Fhd) Unmonitor(filenames ...string) error {
-	return me.db.Update(func(tx *bolt.Tx) error {
+	return me.update(func(tx *bolt.Tx) error {
 		states := tx.Bucket(statesBucket)
 		if states == nil {
 			return fmt.Errorf("failed to find %q", statesBucket)
@@ -138,32 +178,38 @@ func (me *Fhd) Unmonitor(filenames ...string) error {
 	})
 }
 
-// Ignored returns the list of every ignored filename or glob.
-func (me *Fhd) Ignored() ([]string, error) {
-	ignored := make([]string, 0)
-	err := me.db.View(func(tx *bolt.Tx) error {
+// Ignored returns the list of every ignored filename, dirname, or glob.
+func (me *Fhd) Ignored() ([]IgnoreItem, error) {
+	ignored := make([]IgnoreItem, 0)
+	err := me.view(func(tx *bolt.Tx) error {
 		ignores := me.getIgnores(tx)
 		if ignores == nil {
 			return fmt.Errorf("failed to find %q", configIgnore)
 		}
 		cursor := ignores.Cursor()
-		rawFilename, _ := cursor.First()
-		for ; rawFilename != nil; rawFilename, _ = cursor.Next() {
-			ignored = append(ignored, string(rawFilename))
+		rawPattern, rawIgnoreKind := cursor.First()
+		for ; rawPattern != nil; rawPattern,
+			rawIgnoreKind = cursor.Next() {
+			ignored = append(ignored, newIgnoreItemFromRaw(rawPattern,
+				rawIgnoreKind))
 		}
 		return nil
 	})
 	return ignored, err
 }
 
-// Ignore adds the given files or globs to the ignored list.
-func (me *Fhd) Ignore(filenames ...string) error {
-	return me.db.Update(func(tx *bolt.Tx) error {
+// Ignore adds the given filenames, dirnames, or globs to the ignored list.
+// Use NewIgnoreItem to create an IgnoreItem with the kind deduced from its
+// pattern.
+func (me *Fhd) Ignore(ignoreItems ...IgnoreItem) error {
+	return me.update(func(tx *bolt.Tx) error {
 		ignores := me.getIgnores(tx)
+		if ignores == nil {
+			return fmt.Errorf("failed to find %q", configIgnore)
+		}
 		var err error
-		for _, filename := range filenames {
-			if ierr := ignores.Put([]byte(filename),
-				emptyValue); ierr != nil {
+		for _, ignoreItem := range ignoreItems {
+			if ierr := putIgnore(ignores, ignoreItem); ierr != nil {
 				err = errors.Join(err, ierr)
 			}
 		}
@@ -171,15 +217,18 @@ func (me *Fhd) Ignore(filenames ...string) error {
 	})
 }
 
-// Unignore deletes the given filenames or globs from the ignored list.
-// But it never deletes "*.fhd".
-func (me *Fhd) Unignore(filenames ...string) error {
-	return me.db.Update(func(tx *bolt.Tx) error {
+// Unignore deletes the given filenames, dirnames, or globs from the ignored
+// list. But it never deletes "*.fhd".
+func (me *Fhd) Unignore(patterns ...string) error {
+	return me.update(func(tx *bolt.Tx) error {
 		ignores := me.getIgnores(tx)
+		if ignores == nil {
+			return fmt.Errorf("failed to find %q", configIgnore)
+		}
 		var err error
-		for _, filename := range filenames {
-			if filename != "*.fhd" {
-				if ierr := ignores.Delete([]byte(filename)); ierr != nil {
+		for _, pattern := range patterns {
+			if pattern != "*.fhd" {
+				if ierr := ignores.Delete([]byte(pattern)); ierr != nil {
 					err = errors.Join(err, ierr)
 				}
 			}
@@ -188,18 +237,205 @@ func (me *Fhd) Unignore(filenames ...string) error {
 	})
 }
 
+// Unaccounted returns the relative paths of every file in the .fhd file's
+// folder and its subfolders that is neither monitored, nor unmonitored, nor
+// ignored.
+func (me *Fhd) Unaccounted() (gset.Set[string], error) {
+	return me.UnaccountedContext(context.Background())
+}
+
+// UnaccountedContext is like Unaccounted but can be cancelled, in which
+// case ctx.Err() is returned.
+func (me *Fhd) UnaccountedContext(ctx context.Context) (gset.Set[string],
+	error) {
+	unaccounted := gset.New[string]()
+	err := me.view(func(tx *bolt.Tx) error {
+		states := tx.Bucket(statesBucket)
+		if states == nil {
+			return fmt.Errorf("failed to find %q", statesBucket)
+		}
+		ignores := me.getIgnores(tx)
+		if ignores == nil {
+			return fmt.Errorf("failed to find %q", configIgnore)
+		}
+		return me.addUnaccounted(ctx, states, ignores, unaccounted)
+	})
+	return unaccounted, err
+}
+
+// Status returns the status of every monitored file compared with its most
+// recently saved content without doing a save.
+func (me *Fhd) Status() ([]*StatusItem, error) {
+	return me.StatusContext(context.Background())
+}
+
+// StatusContext is like Status but can be cancelled, in which case
+// ctx.Err() is returned.
+func (me *Fhd) StatusContext(ctx context.Context) ([]*StatusItem, error) {
+	monitored, err := me.Monitored()
+	if err != nil {
+		return nil, err
+	}
+	statusItems := make([]*StatusItem, 0, len(monitored))
+	err = me.view(func(tx *bolt.Tx) error {
+		saves := tx.Bucket(savesBucket)
+		if saves == nil {
+			return fmt.Errorf("failed to find %q", savesBucket)
+		}
+		var err error
+		for _, stateItem := range monitored {
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+			statusItem, ierr := me.status(saves, stateItem)
+			if ierr != nil {
+				err = errors.Join(err, ierr)
+			} else {
+				statusItems = append(statusItems, statusItem)
+			}
+		}
+		return err
+	})
+	return statusItems, err
+}
+
 // Save saves a snapshot of every monitored file that's changed and returns
 // the corresponding SaveResult with the new save ID (SID) and sets of any
 // missing and ignored files (which have now become unmonitored—or ignored).
+// If nothing has changed no save is made (unless KeepEmptySaves is true)
+// and the SaveResult has NoChanges set and an invalid SID.
 func (me *Fhd) Save(comment string) (SaveResult, error) {
-	return me.save(comment, nil, nil)
+	return me.SaveContext(context.Background(), comment)
+}
+
+// SaveContext is like Save but can be cancelled: if the context is done
+// before the save is committed, the save is rolled back and ctx.Err() is
+// returned.
+func (me *Fhd) SaveContext(ctx context.Context, comment string) (SaveResult,
+	error) {
+	return me.save(ctx, comment, nil, nil, false)
+}
+
+// KeepEmptySaves returns true if saves where nothing has changed are kept,
+// e.g., as comment-only checkpoints. The default is false.
+func (me *Fhd) KeepEmptySaves() bool {
+	var keep bool
+	_ = me.view(func(tx *bolt.Tx) error {
+		keep = getConfigFlag(tx, configKeepEmpty)
+		return nil
+	})
+	return keep
+}
+
+// SetKeepEmptySaves sets whether saves where nothing has changed are kept.
+func (me *Fhd) SetKeepEmptySaves(keep bool) error {
+	return me.update(func(tx *bolt.Tx) error {
+		return putConfigFlag(tx, configKeepEmpty, keep)
+	})
+}
+
+// Paranoid returns true if every save reads and hashes every monitored
+// file even if its size, modification time, inode, and mode are unchanged.
+func (me *Fhd) Paranoid() bool {
+	var paranoid bool
+	_ = me.view(func(tx *bolt.Tx) error {
+		paranoid = getConfigFlag(tx, configParanoid)
+		return nil
+	})
+	return paranoid
+}
+
+// SetParanoid sets whether every save reads and hashes every monitored
+// file.
+func (me *Fhd) SetParanoid(paranoid bool) error {
+	return me.update(func(tx *bolt.Tx) error {
+		return putConfigFlag(tx, configParanoid, paranoid)
+	})
+}
+
+// MaxWorkers returns the maximum number of files that are read, hashed,
+// and compressed concurrently when saving.
+func (me *Fhd) MaxWorkers() int {
+	me.saving.Lock()
+	defer me.saving.Unlock()
+	return me.workers()
+}
+
+// SetMaxWorkers sets the maximum number of files that are read, hashed,
+// and compressed concurrently when saving; 0 means one per CPU.
+func (me *Fhd) SetMaxWorkers(workers int) {
+	me.saving.Lock()
+	defer me.saving.Unlock()
+	me.maxWorkers = workers
+}
+
+// ChunkThreshold returns the size in bytes at or above which files are
+// saved and extracted by streaming them a chunk at a time rather than by
+// holding them in memory.
+func (me *Fhd) ChunkThreshold() int64 {
+	var threshold int64
+	_ = me.view(func(tx *bolt.Tx) error {
+		threshold = getChunkThreshold(tx)
+		return nil
+	})
+	return threshold
+}
+
+// SetChunkThreshold sets the size in bytes at or above which files are
+// streamed; 0 means the default (64MB).
+func (me *Fhd) SetChunkThreshold(threshold int64) error {
+	if threshold <= 0 {
+		threshold = defaultChunkThreshold
+	}
+	return me.update(func(tx *bolt.Tx) error {
+		config := tx.Bucket(configBucket)
+		if config == nil {
+			return fmt.Errorf("failed to find %q", configBucket)
+		}
+		return config.Put(configChunkThreshold,
+			binary.BigEndian.AppendUint64(nil, uint64(threshold)))
+	})
+}
+
+// Codecs returns the Ids of the codecs to try for files matching each glob
+// pattern. Files that match no pattern are tried with flate and LZW. The
+// smallest result is kept (or the raw content if it isn't smaller).
+func (me *Fhd) Codecs() (map[string][]byte, error) {
+	codecIds := make(map[string][]byte)
+	err := me.view(func(tx *bolt.Tx) error {
+		codecs := getCodecs(tx)
+		if codecs == nil {
+			return fmt.Errorf("failed to find %q", configCodecs)
+		}
+		return codecs.ForEach(func(rawPattern, ids []byte) error {
+			codecIds[string(rawPattern)] = bytes.Clone(ids)
+			return nil
+		})
+	})
+	return codecIds, err
+}
+
+// SetCodecs sets the Ids of the codecs to try for files matching the given
+// glob pattern, e.g., SetCodecs("*.png", CodecNone) to never compress PNG
+// files. If no Ids are given the pattern is deleted.
+func (me *Fhd) SetCodecs(pattern string, ids ...byte) error {
+	return me.update(func(tx *bolt.Tx) error {
+		codecs := getCodecs(tx)
+		if codecs == nil {
+			return fmt.Errorf("failed to find %q", configCodecs)
+		}
+		if len(ids) == 0 {
+			return codecs.Delete([]byte(pattern))
+		}
+		return putCodecIds(codecs, pattern, ids)
+	})
 }
 
 // SaveInfoItemForSid returns the SaveInfoItem for the given SID or an
 // invalid SaveInfoItem on error.
 func (me *Fhd) SaveInfoItemForSid(sid SID) SaveInfoItem {
 	var saveInfoItem SaveInfoItem
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		saveInfo := tx.Bucket(saveInfoBucket)
 		if saveInfo == nil {
 			return fmt.Errorf("failed to find %q", saveInfoBucket)
@@ -232,7 +468,7 @@ func (me *Fhd) SaveCountForSid(sid SID) int {
 	if !sid.IsValid() {
 		return 0
 	}
-	_ = me.db.View(func(tx *bolt.Tx) error {
+	_ = me.view(func(tx *bolt.Tx) error {
 		saves := tx.Bucket(savesBucket)
 		if saves != nil {
 			save := saves.Bucket(sid.marshal())
@@ -248,7 +484,7 @@ func (me *Fhd) SaveCountForSid(sid SID) int {
 // Sid returns the most recent Save ID (SID) or InvalidSID on error.
 func (me *Fhd) Sid() SID {
 	var sid SID
-	_ = me.db.View(func(tx *bolt.Tx) error {
+	_ = me.view(func(tx *bolt.Tx) error {
 		saves := tx.Bucket(savesBucket)
 		if saves != nil {
 			cursor := saves.Cursor()
@@ -263,7 +499,7 @@ func (me *Fhd) Sid() SID {
 // Returns all the Save IDs (SIDs) from most- to least-recent.
 func (me *Fhd) Sids() ([]SID, error) {
 	sids := make([]SID, 0)
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		saves := tx.Bucket(savesBucket)
 		if saves == nil {
 			return fmt.Errorf("failed to find %q", savesBucket)
@@ -282,7 +518,7 @@ func (me *Fhd) Sids() ([]SID, error) {
 func (me *Fhd) StateForFilename(filename string) (StateVal, error) {
 	rawFilename := []byte(me.relativePath(filename))
 	var stateVal StateVal
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		states := tx.Bucket(statesBucket)
 		if states == nil {
 			return fmt.Errorf("failed to find %q", statesBucket)
@@ -300,20 +536,17 @@ func (me *Fhd) StateForFilename(filename string) (StateVal, error) {
 func (me *Fhd) SidsForFilename(filename string) ([]SID, error) {
 	rawFilename := []byte(me.relativePath(filename))
 	sids := make([]SID, 0)
-	err := me.db.View(func(tx *bolt.Tx) error {
-		saves := tx.Bucket(savesBucket)
-		if saves == nil {
-			return fmt.Errorf("failed to find %q", savesBucket)
-		}
-		cursor := saves.Cursor()
-		rawSid, _ := cursor.Last()
-		for ; rawSid != nil; rawSid, _ = cursor.Prev() {
-			if save := saves.Bucket(rawFilename); save != nil {
-				sids = append(sids, unmarshalSid(rawSid))
-			}
+	err := me.view(func(tx *bolt.Tx) error {
+		history, err := getHistory(tx)
+		if err != nil {
+			return err
 		}
+		sids = sidsForFilename(history, rawFilename)
 		return nil
 	})
+	for i, j := 0, len(sids)-1; i < j; i, j = i+1, j-1 {
+		sids[i], sids[j] = sids[j], sids[i]
+	}
 	return sids, err
 }
 
@@ -332,69 +565,205 @@ func (me *Fhd) ExtractFile(filename string) (string, error) {
 // (identified by its SID) to new filename, filename#SID.ext, and returns
 // the new filename.
 func (me *Fhd) ExtractFileForSid(sid SID, filename string) (string, error) {
-	extracted := getExtractFilename(sid, filename)
+	filename = me.relativePath(filename)
+	extracted := getExtractFilename(sid, me.diskPath(filename))
 	file, err := os.OpenFile(extracted, os.O_WRONLY|os.O_CREATE,
 		gong.ModeUserRW)
 	if err != nil {
-		return extracted, err
+		return me.relativePath(extracted), err
 	}
 	defer file.Close()
 	err = me.ExtractForSid(sid, filename, file)
-	return extracted, err
+	return me.relativePath(extracted), err
 }
 
 // Writes the content of the given filename from the most recently saved
 // change to the given writer.
 func (me *Fhd) Extract(filename string, writer io.Writer) error {
+	return me.ExtractContext(context.Background(), filename, writer)
+}
+
+// ExtractContext is like Extract but can be cancelled, in which case
+// ctx.Err() is returned and only some of the content may have been
+// written.
+func (me *Fhd) ExtractContext(ctx context.Context, filename string,
+	writer io.Writer) error {
 	filename = me.relativePath(filename)
 	stateVal, err := me.StateForFilename(filename)
 	if err != nil {
 		return err
 	}
-	return me.ExtractForSid(stateVal.LastSid, filename, writer)
+	return me.ExtractForSidContext(ctx, stateVal.LastSid, filename, writer)
 }
 
 // Writes the content of the given filename from the specified Save
 // (identified by its SID) to the given writer.
 func (me *Fhd) ExtractForSid(sid SID, filename string,
 	writer io.Writer) error {
-	rawFilename := []byte(me.relativePath(filename))
-	return me.db.View(func(tx *bolt.Tx) error {
-		saves := tx.Bucket(savesBucket)
-		if saves == nil {
-			return fmt.Errorf("failed to find %q", savesBucket)
+	return me.ExtractForSidContext(context.Background(), sid, filename,
+		writer)
+}
+
+// ExtractForSidContext is like ExtractForSid but can be cancelled (see
+// ExtractContext).
+func (me *Fhd) ExtractForSidContext(ctx context.Context, sid SID,
+	filename string, writer io.Writer) error {
+	filename = me.relativePath(filename)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	writer = contextWriter{ctx, writer}
+	return me.view(func(tx *bolt.Tx) error {
+		saveVal, err := me.findSaveVal(tx, sid, filename)
+		if err != nil {
+			return err
 		}
-		save := saves.Bucket(sid.marshal())
-		if save == nil {
-			return fmt.Errorf("failed to find save %d", sid)
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
 		}
-		rawSaveVal := save.Get(rawFilename)
-		if rawSaveVal == nil {
-			return fmt.Errorf("failed to find file %s in save %d", filename,
-				sid)
+		return writeBlob(blobs, writer, saveVal.Sha)
+	})
+}
+
+// Restore overwrites the given file with its content from the specified
+// Save (identified by its SID). If the file's current content isn't the
+// same as its most recently saved content, it is first saved with the
+// comment "before restore", and the corresponding SaveResult is returned;
+// otherwise an invalid SaveResult is returned.
+func (me *Fhd) Restore(sid SID, filename string) (SaveResult, error) {
+	return me.RestoreContext(context.Background(), sid, filename)
+}
+
+// RestoreContext is like Restore but can be cancelled, in which case
+// ctx.Err() is returned and the file is left as it was.
+func (me *Fhd) RestoreContext(ctx context.Context, sid SID,
+	filename string) (SaveResult, error) {
+	filename = me.relativePath(filename)
+	saveResult := newInvalidSaveResult()
+	if me.options.ReadOnly {
+		return saveResult, ErrReadOnly
+	}
+	if err := me.checkSaved(sid, filename); err != nil {
+		return saveResult, err
+	}
+	stateItem, changed, err := me.changedSinceSave(filename)
+	if err != nil {
+		return saveResult, err
+	}
+	if changed {
+		saveResult, err = me.saveStateItems(ctx, restoreComment,
+			[]*StateItem{stateItem}, nil, nil, false)
+		if err != nil {
+			return saveResult, err
 		}
-		saveVal := unmarshalSaveVal(rawSaveVal)
+	}
+	if err = me.restoreTo(ctx, sid, filename,
+		me.diskPath(filename)); err != nil {
+		return saveResult, err
+	}
+	me.newProgressReporter(ctx, 1, 0).report(ProgressRestored, filename, 0,
+		0)
+	return saveResult, nil
+}
+
+// SnapshotSids returns the SID of the save holding each monitored file's
+// content as it was at the specified Save (identified by its SID), i.e.,
+// the most recent save at or before the SID that has the file. Files with
+// no such save are omitted.
+func (me *Fhd) SnapshotSids(sid SID) (map[string]SID, error) {
+	var sids map[string]SID
+	err := me.view(func(tx *bolt.Tx) error {
 		var err error
-		rawReader := bytes.NewReader(saveVal.Blob)
-		switch saveVal.Compression {
-		case noCompression:
-			_, err = io.Copy(writer, rawReader)
-		case flateCompression:
-			flateReader := flate.NewReader(rawReader)
-			_, err = io.Copy(writer, flateReader)
-		case lzwCompression:
-			lzwReader := lzw.NewReader(rawReader, lzw.MSB, 0)
-			_, err = io.Copy(writer, lzwReader)
-		default:
-			return fmt.Errorf("invalid compression %v", saveVal.Compression)
-		}
+		sids, err = me.snapshotSids(tx, sid)
 		return err
 	})
+	return sids, err
+}
+
+// RestoreSnapshot writes the content of every monitored file as it was at
+// the specified Save (identified by its SID) into destDir, creating
+// subfolders as needed, and returns the filenames actually written (even
+// if there's an error). (A relative destDir is relative to the .fhd file's
+// folder.) Unless overwrite is true, if any of the files already exist in
+// destDir then nothing is written and an error is returned.
+func (me *Fhd) RestoreSnapshot(sid SID, destDir string,
+	overwrite bool) ([]string, error) {
+	return me.RestoreSnapshotContext(context.Background(), sid, destDir,
+		overwrite)
+}
+
+// RestoreSnapshotContext is like RestoreSnapshot but can be cancelled, in
+// which case ctx.Err() is returned: the file being written is left as it
+// was, but those already written stay written (and are returned).
+func (me *Fhd) RestoreSnapshotContext(ctx context.Context, sid SID,
+	destDir string, overwrite bool) ([]string, error) {
+	sids, err := me.SnapshotSids(sid)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := snapshotTargets(sids, me.diskPath(destDir), overwrite)
+	if err != nil {
+		return nil, err
+	}
+	filenames := gong.SortedMapKeys(targets)
+	restored := make([]string, 0, len(filenames))
+	progress := me.newProgressReporter(ctx, len(filenames), 0)
+	for _, filename := range filenames {
+		if cerr := ctx.Err(); cerr != nil {
+			return restored, cerr
+		}
+		if ierr := me.restoreTo(ctx, sids[filename], filename,
+			targets[filename]); ierr != nil {
+			err = errors.Join(err, ierr)
+			progress.report(ProgressFailed, filename, 0, 0)
+		} else {
+			restored = append(restored, filename)
+			progress.report(ProgressRestored, filename, 0, 0)
+		}
+	}
+	return restored, err
+}
+
+// Diff returns the differences between the given text file's content in
+// the specified Saves (identified by their SIDs).
+func (me *Fhd) Diff(filename string, sidA, sidB SID) (*Diff, error) {
+	filename = me.relativePath(filename)
+	a, err := me.textForSid(sidA, filename)
+	if err != nil {
+		return nil, err
+	}
+	b, err := me.textForSid(sidB, filename)
+	if err != nil {
+		return nil, err
+	}
+	return newDiff(filename, sidA, sidB, a, b), nil
+}
+
+// DiffWorking returns the differences between the given text file's content
+// in the specified Save (identified by its SID) and its current content.
+func (me *Fhd) DiffWorking(filename string, sid SID) (*Diff, error) {
+	filename = me.relativePath(filename)
+	a, err := me.textForSid(sid, filename)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(me.diskPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	if kind := fileKindForRaw(b); kind != txtKind {
+		return nil, fmt.Errorf("can't diff %s: its current content isn't "+
+			"text (%s)", filename, kind)
+	}
+	return newDiff(filename, sid, InvalidSID, a, b), nil
 }
 
 // Rename oldFilename to newFilename. This is merely a convenience for
 // fhd.Unmonitor(oldFilename) followed by fhd.Monitor(newFilename).
 func (me *Fhd) Rename(oldFilename, newFilename string) (SaveResult, error) {
+	oldFilename = me.relativePath(oldFilename)
+	newFilename = me.relativePath(newFilename)
 	err1 := me.Unmonitor(oldFilename)
 	saveResult, err2 := me.MonitorWithComment(
 		fmt.Sprintf("renamed %q → %q", oldFilename, newFilename),
@@ -408,27 +777,178 @@ func (me *Fhd) Rename(oldFilename, newFilename string) (SaveResult, error) {
 	return saveResult, errors.Join(err1, err2)
 }
 
-// Compact eliminates wasted space in the .fhd file.
-func (me *Fhd) Compact() error {
-	// temp := me.db.Path() + ".$$$"
-	// me.db.CopyFile(temp)
-	// move me.db.Path() to tempdir/tempname
-	// rename temp dropping ".$$$"
-	// delete tempdir/tempname
-	return errors.New("Compact unimplemented") // TODO
+// Compact eliminates wasted space in the .fhd file and returns the file's
+// size in bytes before and after compaction. The data is copied into a
+// temporary file which is checked and then renamed over the original, so
+// if anything fails the original is left untouched.
+func (me *Fhd) Compact() (int64, int64, error) {
+	return me.CompactContext(context.Background())
 }
 
-// Delete deletes the given file for the given save.
-// If this is the only occurrence of the file, adds the filename to the
+// CompactContext is like Compact but can be cancelled, in which case
+// ctx.Err() is returned and the original is left untouched. (Cancellation
+// takes effect between the copying, checking, and renaming steps.)
+func (me *Fhd) CompactContext(ctx context.Context) (int64, int64, error) {
+	if me.options.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	me.saving.Lock()
+	defer me.saving.Unlock()
+	me.dbLock.Lock()
+	defer me.dbLock.Unlock()
+	filename := me.filename
+	before, err := fileSize(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	temp := filename + compactSuffix
+	if err = me.compactTo(ctx, temp); err != nil {
+		_ = os.Remove(temp)
+		return before, before, err
+	}
+	if err = me.db.Close(); err != nil {
+		_ = os.Remove(temp)
+		return before, before, errors.Join(err, me.reopen(filename))
+	}
+	if err = os.Rename(temp, filename); err != nil {
+		_ = os.Remove(temp)
+		return before, before, errors.Join(err, me.reopen(filename))
+	}
+	if err = me.reopen(filename); err != nil {
+		return before, before, err
+	}
+	after, err := fileSize(filename)
+	return before, after, err
+}
+
+// Recompress decodes every blob, checks its SHA256, and rewrites it using
+// the best of the current codecs (or those given in the options) if that
+// is smaller. The work is done in bounded-size transactions: if it is
+// interrupted, calling Recompress again resumes where it left off.
+func (me *Fhd) Recompress(options RecompressOptions) (RecompressResult,
+	error) {
+	return me.RecompressContext(context.Background(), options)
+}
+
+// RecompressContext is like Recompress but can be cancelled, in which case
+// the current transaction is rolled back and ctx.Err() is returned along
+// with the result so far; calling Recompress again resumes.
+func (me *Fhd) RecompressContext(ctx context.Context,
+	options RecompressOptions) (RecompressResult, error) {
+	var result RecompressResult
+	if me.options.ReadOnly {
+		return result, ErrReadOnly
+	}
+	maxTxSize := options.MaxTxSize
+	if maxTxSize <= 0 {
+		maxTxSize = compactTxMaxSize
+	}
+	var (
+		filenames map[shA256]string
+		resumeSha []byte
+		done      int
+		total     int
+	)
+	err := me.view(func(tx *bolt.Tx) error {
+		var err error
+		filenames, resumeSha, done, total, err = recompressStart(tx)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	progress := me.newProgressReporter(ctx, total, 0)
+	if progress != nil {
+		progress.files = done
+	}
+	for more := true; more; {
+		var batch RecompressResult // Only counted if committed
+		err = me.update(func(tx *bolt.Tx) error {
+			var err error
+			resumeSha, more, err = me.recompressBatch(ctx, tx, resumeSha,
+				filenames, options.CodecIds, maxTxSize, &batch)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.add(batch)
+		progress.advance(ProgressRecompressed, batch.Blobs, result.NewSize)
+		if options.Progress != nil {
+			options.Progress(done+result.Blobs, total)
+		}
+	}
+	return result, nil
+}
+
+// Delete deletes the given file from the given save. If this was the
+// file's most recent save, the file's state is updated to refer to the
+// most recent save that still has it. If this is the only occurrence of
+// the file, the file's state is deleted and the filename is added to the
 // ignored list.
 func (me *Fhd) Delete(sid SID, filename string) error {
-	//rawFilename = []byte(me.relativePath(filename)) // TODO
-	return errors.New("Delete unimplemented") // TODO
+	filename = me.relativePath(filename)
+	rawFilename := []byte(filename)
+	return me.update(func(tx *bolt.Tx) error {
+		saves := tx.Bucket(savesBucket)
+		if saves == nil {
+			return fmt.Errorf("failed to find %q", savesBucket)
+		}
+		save := saves.Bucket(sid.marshal())
+		if save == nil {
+			return fmt.Errorf("failed to find save %d", sid)
+		}
+		if save.Get(rawFilename) == nil {
+			return fmt.Errorf("failed to find file %s in save %d", filename,
+				sid)
+		}
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
+		}
+		if err = deleteSaveVal(tx, save, blobs, sid,
+			rawFilename); err != nil {
+			return err
+		}
+		return me.updateStateAfterDelete(tx, saves, rawFilename)
+	})
 }
 
-// Purges deletes every save of the given file and adds the filename to the
-// ignored list.
-func (me *Fhd) Purge(filename string) error {
-	//rawFilename = []byte(me.relativePath(filename)) // TODO
-	return errors.New("Purge unimplemented") // TODO
+// Purge deletes every save of the given file, deletes the file's state, and
+// adds the filename to the ignored list. Any saves left empty as a result
+// are deleted too (but their SIDs are never reused). If compact is true
+// the .fhd file is then compacted so that the file's data is really gone
+// from disk.
+func (me *Fhd) Purge(filename string, compact bool) error {
+	filename = me.relativePath(filename)
+	rawFilename := []byte(filename)
+	err := me.update(func(tx *bolt.Tx) error {
+		states := tx.Bucket(statesBucket)
+		if states == nil {
+			return fmt.Errorf("failed to find %q", statesBucket)
+		}
+		ignores := me.getIgnores(tx)
+		if ignores == nil {
+			return fmt.Errorf("failed to find %q", configIgnore)
+		}
+		count, err := me.purge(tx, rawFilename)
+		if err != nil {
+			return err
+		}
+		if count == 0 && states.Get(rawFilename) == nil {
+			return fmt.Errorf("failed to find file %s", filename)
+		}
+		if err = states.Delete(rawFilename); err != nil {
+			return err
+		}
+		if err = deleteStat(tx, rawFilename); err != nil {
+			return err
+		}
+		return putIgnore(ignores, IgnoreItem{Pattern: filename,
+			IgnoreKind: IgnoreFilename})
+	})
+	if err == nil && compact {
+		_, _, err = me.Compact()
+	}
+	return err
 }
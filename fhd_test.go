@@ -2,16 +2,25 @@ package fhd
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mark-summerfield/gong"
 	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -53,40 +62,33 @@ func TestOpen(t *testing.T) {
 				fileformat, fileFormat)
 		}
 		actual = fhd.String()
-		expected := fmt.Sprintf("<Fhd filename=%q format=1>", filename)
+		expected := fmt.Sprintf("<Fhd filename=%q format=%d>", filename,
+			fileFormat)
 		if actual != expected {
 			t.Errorf("expected String of %q, got %q", expected, actual)
 		}
 	}
 }
 
-func TestCompressionForSizes(t *testing.T) {
-	if compression := compressionForSizes(1000, 997,
-		998); compression != noCompression {
-		t.Errorf("expected noCompression, got %s", compression)
-	}
-	if compression := compressionForSizes(1000, 945,
-		998); compression != flateCompression {
-		t.Errorf("expected flateCompression, got %s", compression)
-	}
-	if compression := compressionForSizes(1000, 998,
-		949); compression != lzwCompression {
-		t.Errorf("expected lzwCompression, got %s", compression)
-	}
-	if compression := compressionForSizes(1000, 0,
-		990); compression != noCompression {
-		t.Errorf("expected noCompression, got %s", compression)
-	}
-	if compression := compressionForSizes(1000, 990,
-		0); compression != noCompression {
-		t.Errorf("expected noCompression, got %s", compression)
-	}
-	if compression := compressionForSizes(1000, 889,
-		0); compression != flateCompression {
-		t.Errorf("expected flateCompression, got %s", compression)
+func TestCompressionForCandidates(t *testing.T) {
+	compressions := []compression{flateCompression, lzwCompression}
+	for _, item := range []struct {
+		sizes    []int
+		expected compression
+	}{{[]int{997, 998}, noCompression}, {[]int{945, 998}, flateCompression},
+		{[]int{998, 949}, lzwCompression}, {[]int{0, 990}, noCompression},
+		{[]int{990, 0}, noCompression}, {[]int{889, 0}, flateCompression},
+		{[]int{0, 889}, lzwCompression}, {[]int{900, 900}, flateCompression},
+		{[]int{0, 0}, noCompression}} {
+		if compression := compressionForCandidates(1000, compressions,
+			item.sizes); compression != item.expected {
+			t.Errorf("%v: expected %s, got %s", item.sizes, item.expected,
+				compression)
+		}
 	}
-	if compression := compressionForSizes(1000, 0,
-		889); compression != lzwCompression {
+	if compression := compressionForCandidates(1000, []compression{
+		noCompression, flateCompression, lzwCompression},
+		[]int{0, 900, 800}); compression != lzwCompression {
 		t.Errorf("expected lzwCompression, got %s", compression)
 	}
 }
@@ -642,6 +644,2533 @@ func Test_tdata(t *testing.T) {
 	}
 }
 
+func TestCompact(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp3.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file3.txt"
+		closer, err := makeTempFile(file1, strings.Repeat("Line\n", 999))
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err = makeTempFile(file1, strings.Repeat(
+				fmt.Sprintf("Line %d\n", i), 999)); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if _, err = fhd.Save(""); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		before, after, err := fhd.Compact()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if after > before {
+			t.Errorf("expected at most %d bytes, got %d", before, after)
+		}
+		if gong.FileExists(filename + compactSuffix) {
+			t.Errorf("unexpected leftover %q", filename+compactSuffix)
+		}
+		var buffer bytes.Buffer
+		if err = fhd.Extract(file1, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !compareFileWithRaw(file1, buffer.Bytes()) {
+			t.Errorf("expected equal for %s", file1)
+		}
+		if _, err = makeTempFile(file1, "changed\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		saveResult, err := fhd.Save("after compact")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.Sid != 7 {
+			t.Errorf("expected SID of 7, got %d", saveResult.Sid)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp4.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file4.txt"
+		closer, err := makeTempFile(file1, "version 1\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for _, content := range []string{"version 2\n", "version 3\n"} {
+			if _, err = makeTempFile(file1, content); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if _, err = fhd.Save(""); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		if err = fhd.Delete(9, file1); err == nil {
+			t.Error("expected error for missing save")
+		}
+		if err = fhd.Delete(1, "nosuchfile.txt"); err == nil {
+			t.Error("expected error for missing file")
+		}
+		if err = fhd.Delete(3, file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		stateVal, err := fhd.StateForFilename(file1)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if stateVal.LastSid != 2 {
+			t.Errorf("expected LastSid of 2, got %d", stateVal.LastSid)
+		}
+		var buffer bytes.Buffer
+		if err = fhd.Extract(file1, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if buffer.String() != "version 2\n" {
+			t.Errorf("expected \"version 2\", got %q", buffer.String())
+		}
+		if err = fhd.ExtractForSid(3, file1, &buffer); err == nil {
+			t.Error("expected error for deleted file")
+		}
+		sids, err := fhd.SidsForFilename(file1)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Equal(sids, []SID{2, 1}) {
+			t.Errorf("expected SIDs [2 1], got %v", sids)
+		}
+		for _, sid := range []SID{1, 2} {
+			if err = fhd.Delete(sid, file1); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		states, err := fhd.States()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if len(states) != 0 {
+			t.Errorf("expected 0 states, got %d", len(states))
+		}
+		ignored, err := fhd.Ignored()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Contains(ignored, IgnoreItem{Pattern: file1,
+			IgnoreKind: IgnoreFilename}) {
+			t.Errorf("expected %q to be ignored", file1)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp5.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file5a.txt"
+		closer, err := makeTempFile(file1, "keep me\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		file2 := "file5b.txt"
+		closer, err = makeTempFile(file2, "secret 1\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1, file2); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file2, "secret 2\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Purge("nosuchfile.txt", false); err == nil {
+			t.Error("expected error for missing file")
+		}
+		if err = fhd.Purge(file2, true); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		sids, err := fhd.Sids()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Equal(sids, []SID{1}) {
+			t.Errorf("expected SIDs [1], got %v", sids)
+		}
+		if saveInfoItem := fhd.SaveInfoItemForSid(2); saveInfoItem.IsValid() {
+			t.Errorf("expected no save info for SID 2, got %v",
+				saveInfoItem)
+		}
+		states, err := fhd.States()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if len(states) != 1 || states[0].Filename != file1 {
+			t.Errorf("expected only %q's state, got %v", file1, states)
+		}
+		ignored, err := fhd.Ignored()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Contains(ignored, IgnoreItem{Pattern: file2,
+			IgnoreKind: IgnoreFilename}) {
+			t.Errorf("expected %q to be ignored", file2)
+		}
+		raw, err := os.ReadFile(filename)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if bytes.Contains(raw, []byte("secret")) {
+			t.Errorf("expected no trace of %q", file2)
+		}
+		var buffer bytes.Buffer
+		if err = fhd.Extract(file1, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !compareFileWithRaw(file1, buffer.Bytes()) {
+			t.Errorf("expected equal for %s", file1)
+		}
+		if _, err = makeTempFile(file1, "keep me too\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		saveResult, err := fhd.Save("")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.Sid != 3 {
+			t.Errorf("expected purged SID 2 not to be reused, got %d",
+				saveResult.Sid)
+		}
+	}
+}
+
+func TestPurgeDeltaBases(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	fhd, err := New("temp6b.fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	var text strings.Builder
+	for i := 0; i < 300; i++ {
+		text.WriteString(fmt.Sprintf("This is line #%d of the text\n", i))
+	}
+	secret := "password=hunter2SECRET\n"
+	// a.txt's second version is a delta against its first which has the
+	// secret, and b.txt has the same content as a.txt's second version
+	fileA, fileB, fileC, fileD := "a.txt", "b.txt", "c.txt", "d.txt"
+	if _, err = makeTempFile(fileA, secret+text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(fileA); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(fileA, text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Save(""); err != nil { // #2
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(fileB, text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(fileB); err != nil { // #3
+		t.Errorf("unexpected error: %s", err)
+	}
+	// Likewise for c.txt and d.txt except that the save of c.txt's first
+	// version is deleted so its blob is only a delta base
+	text.WriteString("More text\n")
+	if _, err = makeTempFile(fileC, secret+text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(fileC); err != nil { // #4
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(fileC, text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Save(""); err != nil { // #5
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = fhd.Delete(4, fileC); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(fileD, text.String()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(fileD); err != nil { // #6
+		t.Errorf("unexpected error: %s", err)
+	}
+	if deltas := countBlobs(fhd, deltaCompression); deltas != 2 {
+		t.Errorf("expected 2 deltas, got %d", deltas)
+	}
+	for _, file := range []string{fileA, fileC} {
+		if err = fhd.Purge(file, true); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if deltas := countBlobs(fhd, deltaCompression); deltas != 0 {
+		t.Errorf("expected no deltas, got %d", deltas)
+	}
+	if err = fhd.view(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(blobsBucket)
+		return blobs.ForEach(func(rawSha, _ []byte) error {
+			raw, err := blobContent(blobs, shA256(rawSha))
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(raw, []byte(secret)) {
+				t.Errorf("blob %x still has the secret", rawSha)
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkBlobRefs(t, fhd, []uint32{1, 1})
+	for _, file := range []string{fileB, fileD} {
+		var buffer bytes.Buffer
+		if err = fhd.Extract(file, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !compareFileWithRaw(file, buffer.Bytes()) {
+			t.Errorf("%s: extracted content doesn't match", file)
+		}
+	}
+}
+
+func countBlobs(fhd *Fhd, compression compression) int {
+	count := 0
+	_ = fhd.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobsBucket).ForEach(func(_, raw []byte) error {
+			if unmarshalBlobVal(raw).Compression == compression {
+				count++
+			}
+			return nil
+		})
+	})
+	return count
+}
+
+func TestIgnore(t *testing.T) {
+	filename := filepath.Join(os.TempDir(), "temp6.fhd")
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		err = fhd.Ignore(NewIgnoreItem("build/"), NewIgnoreItem("*.log"),
+			NewIgnoreItem("notes.txt"), NewIgnoreItem("docs/old.txt"),
+			IgnoreItem{Pattern: "node_*", IgnoreKind: IgnoreDirname})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Ignore(IgnoreItem{Pattern: "x",
+			IgnoreKind: 'x'}); err == nil {
+			t.Error("expected error for invalid ignore kind")
+		}
+		ignored, err := fhd.Ignored()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for _, ignoreItem := range []IgnoreItem{
+			{Pattern: "build", IgnoreKind: IgnoreDirname},
+			{Pattern: "*.log", IgnoreKind: IgnoreGlob},
+			{Pattern: "notes.txt", IgnoreKind: IgnoreFilename},
+			{Pattern: "*.fhd", IgnoreKind: IgnoreGlob}} {
+			if !slices.Contains(ignored, ignoreItem) {
+				t.Errorf("expected %v to be ignored", ignoreItem)
+			}
+		}
+		_ = fhd.db.View(func(tx *bolt.Tx) error {
+			ignores := fhd.getIgnores(tx)
+			for name, expected := range map[string]bool{
+				"main.go":                     false,
+				"build/main.o":                true,
+				"src/build/out/a.txt":         true,
+				"src/builder/a.txt":           false,
+				"app.log":                     true,
+				"logs/app.log":                true,
+				"notes.txt":                   true,
+				"old/notes.txt":               true,
+				"docs/old.txt":                true,
+				"old.txt":                     false,
+				"web/node_modules/x/index.js": true,
+				"web/nodes/index.js":          false,
+				"data.fhd":                    true,
+				"buildnotes.md":               false,
+			} {
+				name = filepath.FromSlash(name)
+				actual := fhd.mustIgnore(ignores, name)
+				if actual != expected {
+					t.Errorf("expected mustIgnore(%q) %t, got %t", name,
+						expected, actual)
+				}
+			}
+			return nil
+		})
+		if err = fhd.Unignore("*.log", "*.fhd"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		ignored, err = fhd.Ignored()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if slices.Contains(ignored, IgnoreItem{Pattern: "*.log",
+			IgnoreKind: IgnoreGlob}) {
+			t.Error("expected \"*.log\" to be unignored")
+		}
+		if !slices.Contains(ignored, IgnoreItem{Pattern: "*.fhd",
+			IgnoreKind: IgnoreGlob}) {
+			t.Error("expected \"*.fhd\" to still be ignored")
+		}
+		err = fhd.db.Update(func(tx *bolt.Tx) error { // old format
+			return fhd.getIgnores(tx).Put([]byte("*.old"), []byte{})
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if fhd, err = New(filename); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		ignored, err = fhd.Ignored()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Contains(ignored, IgnoreItem{Pattern: "*.old",
+			IgnoreKind: IgnoreGlob}) {
+			t.Errorf("expected migrated \"*.old\" glob, got %v", ignored)
+		}
+	}
+}
+
+func TestUnaccounted(t *testing.T) {
+	root, err := os.MkdirTemp("", "fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(root) }()
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(root)
+	defer func() { _ = os.Chdir(dir) }()
+	for _, name := range []string{"a.txt", "b.txt", "c.bak", ".hidden",
+		".git/config", "sub/c.txt", "sub/.d.txt", "sub/build/e.txt",
+		"sub/deep/f.txt", "g.txt"} {
+		name = filepath.FromSlash(name)
+		if err = os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(name, name+"\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	filename := "temp7.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		if _, err = fhd.Monitor("a.txt", "g.txt"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Unmonitor("g.txt"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Ignore(NewIgnoreItem("build/")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		unaccounted, err := fhd.Unaccounted()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		expected := []string{"b.txt", filepath.FromSlash("sub/c.txt"),
+			filepath.FromSlash("sub/deep/f.txt")}
+		if actual := unaccounted.ToSortedSlice(); !slices.Equal(actual,
+			expected) {
+			t.Errorf("expected %v, got %v", expected, actual)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err = fhd.UnaccountedContext(ctx); !errors.Is(err,
+			context.Canceled) {
+			t.Errorf("expected cancellation, got %v", err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp8.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file8.txt"
+		closer, err := makeTempFile(file1, "one\ntwo\nthree\nfour\nfive\n"+
+			"six\nseven\neight\nnine\nten\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		file2 := "file8.bin"
+		closer, err = makeTempFile(file2, "\x00\x01\x02\x03")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1, file2); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file1, "one\n2\nthree\nfour\nfive\n"+
+			"six\nseven\neight\nnine\nten\neleven"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		diff, err := fhd.Diff(file1, 1, 2)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else {
+			expected := `--- file8.txt#1
++++ file8.txt#2
+@@ -1,3 +1,3 @@
+ one
+-two
++2
+ three
+@@ -10 +10,2 @@
+ ten
++eleven
+\ No newline at end of file
+`
+			if actual := diff.Unified(1); actual != expected {
+				t.Errorf("expected\n%s\ngot\n%s", expected, actual)
+			}
+			expectedHunks := []DiffHunk{{DiffEqual, 0, 1, 0, 1},
+				{DiffDelete, 1, 2, 1, 1}, {DiffInsert, 2, 2, 1, 2},
+				{DiffEqual, 2, 10, 2, 10}, {DiffInsert, 10, 10, 10, 11}}
+			if !slices.Equal(diff.Hunks, expectedHunks) {
+				t.Errorf("expected %v, got %v", expectedHunks, diff.Hunks)
+			}
+		}
+		diff, err = fhd.DiffWorking(file1, 2)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if !diff.IsSame() || diff.Unified(3) != "" {
+			t.Errorf("expected no differences, got %v", diff.Hunks)
+		}
+		if _, err = fhd.Diff(file2, 1, 1); err == nil {
+			t.Error("expected error for binary file")
+		}
+	}
+	for _, pair := range [][2]string{{"", "a\nb\n"}, {"a\nb\n", ""},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+		{"x\ny\n", "x\ny\n"}, {"a\nb\nc\n", "d\ne\nf\n"}} {
+		diff := newDiff("x", 1, 2, []byte(pair[0]), []byte(pair[1]))
+		var a, b strings.Builder
+		for _, hunk := range diff.Hunks {
+			if hunk.Kind != DiffInsert {
+				a.WriteString(strings.Join(
+					diff.ALines[hunk.AStart:hunk.AEnd], ""))
+			}
+			if hunk.Kind != DiffDelete {
+				b.WriteString(strings.Join(
+					diff.BLines[hunk.BStart:hunk.BEnd], ""))
+			}
+		}
+		if a.String() != pair[0] || b.String() != pair[1] {
+			t.Errorf("hunks %v don't reproduce %q → %q", diff.Hunks,
+				pair[0], pair[1])
+		}
+	}
+	var a, b strings.Builder
+	for i := 0; i < 2000; i++ {
+		a.WriteString(fmt.Sprintf("Line #%d of the first text\n", i))
+		b.WriteString(fmt.Sprintf("Line #%d of the second text\n", i))
+	}
+	if _, ok := textDelta([]byte(a.String()), []byte(b.String()),
+		1000); ok {
+		t.Error("expected a delta of entirely different texts to fail")
+	}
+	delta, ok := textDelta([]byte(a.String()), []byte(b.String()),
+		b.Len())
+	if !ok {
+		t.Error("expected a delta of different texts")
+	} else if raw, err := applyDelta([]byte(a.String()),
+		delta); err != nil || string(raw) != b.String() {
+		t.Errorf("delta doesn't reproduce the second text: %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp9.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file9.txt"
+		closer, err := makeTempFile(file1, "version 1\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file1, "version 2\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file1, "version 3\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Restore(9, file1); err == nil {
+			t.Error("expected error for missing save")
+		}
+		saveResult, err := fhd.Restore(1, file1)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.Sid != 3 || saveResult.Comment != restoreComment {
+			t.Errorf("expected SID 3 %q, got %v", restoreComment,
+				saveResult)
+		}
+		if !compareFileWithRaw(file1, []byte("version 1\n")) {
+			t.Errorf("expected %s to be restored to version 1", file1)
+		}
+		var buffer bytes.Buffer
+		if err = fhd.ExtractForSid(3, file1, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if buffer.String() != "version 3\n" {
+			t.Errorf("expected \"version 3\", got %q", buffer.String())
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		saveResult, err = fhd.Restore(2, file1)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.IsValid() {
+			t.Errorf("expected no save, got %v", saveResult)
+		}
+		if !compareFileWithRaw(file1, []byte("version 2\n")) {
+			t.Errorf("expected %s to be restored to version 2", file1)
+		}
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	root, err := os.MkdirTemp("", "fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(root) }()
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(root)
+	defer func() { _ = os.Chdir(dir) }()
+	fileA := "a.txt"
+	fileB := filepath.Join("sub", "b.txt")
+	fileC := "c.txt"
+	_ = os.Mkdir("sub", 0o755)
+	for _, name := range []string{fileA, fileB} {
+		if _, err = makeTempFile(name, name+" 1\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	filename := "temp10.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		if _, err = fhd.Monitor(fileA, fileB); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(fileA, fileA+" 2\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(fileC, fileC+" 3\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(fileC); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		sids, err := fhd.SnapshotSids(2)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		expected := map[string]SID{fileA: 2, fileB: 1}
+		if !maps.Equal(sids, expected) {
+			t.Errorf("expected %v, got %v", expected, sids)
+		}
+		if _, err = fhd.SnapshotSids(9); err == nil {
+			t.Error("expected error for missing save")
+		}
+		dest := filepath.Join(root, "dest")
+		filenames, err := fhd.RestoreSnapshot(2, dest, false)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !slices.Equal(filenames, []string{fileA, fileB}) {
+			t.Errorf("expected [%s %s], got %v", fileA, fileB, filenames)
+		}
+		for name, content := range map[string]string{fileA: "a.txt 2\n",
+			fileB: fileB + " 1\n"} {
+			if !compareFileWithRaw(filepath.Join(dest, name),
+				[]byte(content)) {
+				t.Errorf("expected %q in %s", content, name)
+			}
+		}
+		if gong.PathExists(filepath.Join(dest, fileC)) {
+			t.Errorf("unexpected %s in snapshot", fileC)
+		}
+		if _, err = fhd.RestoreSnapshot(1, dest, false); err == nil {
+			t.Error("expected error for existing files")
+		}
+		if !compareFileWithRaw(filepath.Join(dest, fileA),
+			[]byte("a.txt 2\n")) {
+			t.Errorf("expected %s to be unchanged", fileA)
+		}
+		if _, err = fhd.RestoreSnapshot(1, dest, true); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !compareFileWithRaw(filepath.Join(dest, fileA),
+			[]byte("a.txt 1\n")) {
+			t.Errorf("expected %s to be overwritten", fileA)
+		}
+		// Only the files actually written are returned
+		blocker := filepath.Join(dest, fileB, "blocker")
+		_ = os.Remove(filepath.Join(dest, fileB))
+		if err = os.MkdirAll(blocker, 0o755); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if filenames, err = fhd.RestoreSnapshot(2, dest,
+			true); err == nil || !slices.Equal(filenames,
+			[]string{fileA}) {
+			t.Errorf("expected [%s] and an error, got %v: %v", fileA,
+				filenames, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if filenames, err = fhd.RestoreSnapshotContext(ctx, 2, dest,
+			true); !errors.Is(err, context.Canceled) ||
+			len(filenames) != 0 {
+			t.Errorf("expected no files and cancellation, got %v: %v",
+				filenames, err)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	root, err := os.MkdirTemp("", "fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(root) }()
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(root)
+	defer func() { _ = os.Chdir(dir) }()
+	files := []string{"a.txt", "b.txt", "c.txt", "d.txt"}
+	for _, name := range files {
+		if _, err = makeTempFile(name, name+"\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	filename := "temp11.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		if _, err = fhd.Monitor(files...); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile("b.txt", "changed\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		_ = os.Remove("c.txt")
+		if _, err = makeTempFile("d.txt", "\x00\x01\x02"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		statusItems, err := fhd.Status()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		expected := []StatusItem{{"a.txt", StatusUnchanged, 1},
+			{"b.txt", StatusModified, 1}, {"c.txt", StatusMissing, 1},
+			{"d.txt", StatusKindChanged, 1}}
+		if len(statusItems) != len(expected) {
+			t.Errorf("expected %d status items, got %d", len(expected),
+				len(statusItems))
+		} else {
+			for i, statusItem := range statusItems {
+				if *statusItem != expected[i] {
+					t.Errorf("expected %v, got %v", expected[i], statusItem)
+				}
+			}
+		}
+		if sid := fhd.Sid(); sid != 1 {
+			t.Errorf("expected SID of 1, got %d", sid)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err = fhd.StatusContext(ctx); !errors.Is(err,
+			context.Canceled) {
+			t.Errorf("expected cancellation, got %v", err)
+		}
+	}
+}
+
+func TestEmptySave(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp12.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file12.txt"
+		closer, err := makeTempFile(file1, "unchanging\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		saveResult, err := fhd.Save("nothing changed")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !saveResult.NoChanges || saveResult.IsValid() {
+			t.Errorf("expected no changes, got %v", saveResult)
+		}
+		if sid := fhd.Sid(); sid != 1 {
+			t.Errorf("expected SID of 1, got %d", sid)
+		}
+		if fhd.KeepEmptySaves() {
+			t.Error("expected empty saves not to be kept by default")
+		}
+		if err = fhd.SetKeepEmptySaves(true); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !fhd.KeepEmptySaves() {
+			t.Error("expected empty saves to be kept")
+		}
+		saveResult, err = fhd.Save("checkpoint")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.NoChanges || saveResult.Sid != 2 {
+			t.Errorf("expected SID of 2, got %v", saveResult)
+		}
+		if count := fhd.SaveCountForSid(2); count != 0 {
+			t.Errorf("expected no saved files, got %d", count)
+		}
+		if comment := fhd.SaveInfoItemForSid(2).Comment; comment !=
+			"checkpoint" {
+			t.Errorf("expected \"checkpoint\", got %q", comment)
+		}
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp13.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file1 := "file13a.txt"
+		closer, err := makeTempFile(file1, "same content\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		file2 := "file13b.txt"
+		closer, err = makeTempFile(file2, "same content\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file1, file2); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file1, "different content\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = makeTempFile(file1, "same content\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		checkBlobRefs(t, fhd, []uint32{1, 3})
+		if err = fhd.Delete(2, file1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		checkBlobRefs(t, fhd, []uint32{3})
+		if err = fhd.Purge(file2, false); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		checkBlobRefs(t, fhd, []uint32{2})
+		err = fhd.db.Update(func(tx *bolt.Tx) error { // back to format 1
+			blobs := tx.Bucket(blobsBucket)
+			saves := tx.Bucket(savesBucket)
+			err := saves.ForEach(func(rawSid, _ []byte) error {
+				save := saves.Bucket(rawSid)
+				return save.ForEach(func(rawFilename,
+					rawSaveVal []byte) error {
+					blobVal := unmarshalBlobVal(blobs.Get(rawSaveVal))
+					raw := append(bytes.Clone(rawSaveVal),
+						byte(blobVal.Compression))
+					return save.Put(rawFilename, append(raw,
+						blobVal.Blob...))
+				})
+			})
+			if err != nil {
+				return err
+			}
+			if err = tx.DeleteBucket(blobsBucket); err != nil {
+				return err
+			}
+			return tx.Bucket(configBucket).Put(configFormat, []byte{1})
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if fhd, err = New(filename); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if format, _ := fhd.FileFormat(); format != int(fileFormat) {
+			t.Errorf("expected format %d, got %d", fileFormat, format)
+		}
+		checkBlobRefs(t, fhd, []uint32{2})
+		for _, sid := range []SID{1, 3} {
+			var buffer bytes.Buffer
+			if err = fhd.ExtractForSid(sid, file1, &buffer); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if buffer.String() != "same content\n" {
+				t.Errorf("expected \"same content\", got %q",
+					buffer.String())
+			}
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp14.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file := "file14.txt"
+		var text strings.Builder
+		for i := 0; i < 200; i++ {
+			text.WriteString(fmt.Sprintf("Line #%d of some text\n", i))
+		}
+		closer, err := makeTempFile(file, text.String())
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		versions := []string{text.String()}
+		for i := 0; i < 2*maxDeltaChain; i++ {
+			text.WriteString(fmt.Sprintf("Extra line #%d\n", i))
+			versions = append(versions, text.String())
+			if _, err = makeTempFile(file, text.String()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if _, err = fhd.Save(""); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		deltas := 0
+		_ = fhd.db.View(func(tx *bolt.Tx) error {
+			blobs := tx.Bucket(blobsBucket)
+			return blobs.ForEach(func(rawSha, raw []byte) error {
+				if unmarshalBlobVal(raw).Compression == deltaCompression {
+					deltas++
+				}
+				if depth := deltaDepth(blobs,
+					shA256(rawSha)); depth >= maxDeltaChain {
+					t.Errorf("expected delta depth < %d, got %d",
+						maxDeltaChain, depth)
+				}
+				return nil
+			})
+		})
+		if deltas == 0 || deltas == len(versions) {
+			t.Errorf("expected some deltas and some full copies, got "+
+				"%d deltas for %d versions", deltas, len(versions))
+		}
+		if err = fhd.Delete(2, file); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for i, version := range versions {
+			if i == 1 { // deleted
+				continue
+			}
+			var buffer bytes.Buffer
+			if err = fhd.ExtractForSid(SID(i+1), file,
+				&buffer); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if buffer.String() != version {
+				t.Errorf("sid #%d: extracted version doesn't match", i+1)
+			}
+		}
+		if err = fhd.Purge(file, false); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		checkBlobRefs(t, fhd, []uint32{})
+	}
+}
+
+func TestBinaryDelta(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp15.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file := "file15.bin"
+		raw := make([]byte, 1<<16)
+		rnd := rand.New(rand.NewSource(15))
+		_, _ = rnd.Read(raw)
+		raw[0] = 0 // make sure it is binary
+		closer, err := makeTempFile(file, string(raw))
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		versions := [][]byte{bytes.Clone(raw)}
+		for _, offset := range []int{100, 30000, 65000} {
+			raw[offset] ^= 0xFF
+			raw = append(raw[:offset+1], append([]byte("inserted"),
+				raw[offset+1:]...)...)
+			versions = append(versions, bytes.Clone(raw))
+			if _, err = makeTempFile(file, string(raw)); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if _, err = fhd.Save(""); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		deltas := 0
+		_ = fhd.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(blobsBucket).ForEach(func(_, raw []byte) error {
+				blobVal := unmarshalBlobVal(raw)
+				if blobVal.Compression == binaryDeltaCompression {
+					deltas++
+					if len(blobVal.Blob) > 1024 {
+						t.Errorf("expected small delta, got %d bytes",
+							len(blobVal.Blob))
+					}
+				}
+				return nil
+			})
+		})
+		if deltas != len(versions)-1 {
+			t.Errorf("expected %d binary deltas, got %d",
+				len(versions)-1, deltas)
+		}
+		for i, version := range versions {
+			var buffer bytes.Buffer
+			if err = fhd.ExtractForSid(SID(i+1), file,
+				&buffer); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(buffer.Bytes(), version) {
+				t.Errorf("sid #%d: extracted version doesn't match", i+1)
+			}
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp16.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		if err = RegisterCodec(zlibCodec{}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = RegisterCodec(zlibCodec{}); err == nil {
+			t.Error("expected error registering a duplicate codec")
+		}
+		if err = fhd.SetCodecs("*.dat", 'Q'); err == nil {
+			t.Error("expected error for unregistered codec")
+		}
+		if err = fhd.SetCodecs("*.dat", 'Z'); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		codecs, err := fhd.Codecs()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if ids := codecs["*.dat"]; string(ids) != "Z" {
+			t.Errorf("expected \"Z\" codecs for *.dat, got %q", ids)
+		}
+		if ids := codecs["*.png"]; string(ids) != "U" {
+			t.Errorf("expected \"U\" codecs for *.png, got %q", ids)
+		}
+		content := strings.Repeat("some compressible content\n", 100)
+		expected := map[string]compression{"file16.dat": 'Z',
+			"file16.png": noCompression, "file16.txt": flateCompression}
+		for name := range expected {
+			closer, err := makeTempFile(name, name+content)
+			defer closer()
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		if _, err = fhd.Monitor(maps.Keys(expected)...); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		for name, compression := range expected {
+			_ = fhd.db.View(func(tx *bolt.Tx) error {
+				saveVal := fhd.getSaveVal(tx.Bucket(savesBucket), name, 1)
+				blobVal := getBlobVal(tx.Bucket(blobsBucket), saveVal.Sha)
+				if blobVal.Compression != compression {
+					t.Errorf("%s: expected compression %s, got %s", name,
+						compression, blobVal.Compression)
+				}
+				return nil
+			})
+			var buffer bytes.Buffer
+			if err = fhd.Extract(name, &buffer); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if buffer.String() != name+content {
+				t.Errorf("%s: extracted content doesn't match", name)
+			}
+		}
+	}
+}
+
+type zlibCodec struct{}
+
+func (me zlibCodec) Id() byte { return 'Z' }
+
+func (me zlibCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(writer, zlib.BestCompression)
+}
+
+func (me zlibCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(reader)
+}
+
+func TestRecompress(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp17.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		if err = fhd.SetCodecs("*.txt", CodecNone); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		files := []string{"file17a.txt", "file17b.txt", "file17c.txt"}
+		for _, file := range files {
+			closer, err := makeTempFile(file, strings.Repeat(file+"\n",
+				100))
+			defer closer()
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+		if _, err = fhd.Monitor(files...); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = fhd.SetCodecs("*.txt"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		var firstSha []byte
+		_ = fhd.db.Update(func(tx *bolt.Tx) error { // as if interrupted
+			rawSha, _ := tx.Bucket(blobsBucket).Cursor().First()
+			firstSha = bytes.Clone(rawSha)
+			return tx.Bucket(configBucket).Put(configRecompress, rawSha)
+		})
+		calls := 0
+		result, err := fhd.Recompress(RecompressOptions{MaxTxSize: 1,
+			Progress: func(done, total int) {
+				calls++
+				if total != len(files) || done != calls+1 {
+					t.Errorf("unexpected progress %d/%d", done, total)
+				}
+			}})
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if result.Blobs != 2 || result.Recompressed != 2 ||
+			result.Saved() <= 0 || calls != 2 {
+			t.Errorf("unexpected result %s (%d calls)", result, calls)
+		}
+		_ = fhd.db.View(func(tx *bolt.Tx) error {
+			if raw := tx.Bucket(configBucket).Get(
+				configRecompress); raw != nil {
+				t.Errorf("expected recompress to be finished, got %x", raw)
+			}
+			return tx.Bucket(blobsBucket).ForEach(func(rawSha,
+				raw []byte) error {
+				compression := unmarshalBlobVal(raw).Compression
+				if bytes.Equal(rawSha, firstSha) {
+					if compression != noCompression {
+						t.Errorf("expected resumed blob to be skipped")
+					}
+				} else if compression == noCompression {
+					t.Errorf("expected recompressed blob")
+				}
+				return nil
+			})
+		})
+		for _, file := range files {
+			var buffer bytes.Buffer
+			if err = fhd.Extract(file, &buffer); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if buffer.String() != strings.Repeat(file+"\n", 100) {
+				t.Errorf("%s: extracted content doesn't match", file)
+			}
+		}
+		file := "file17d.txt"
+		var text strings.Builder
+		for i := 0; i < 200; i++ {
+			text.WriteString(fmt.Sprintf("Line #%d of some text\n", i))
+		}
+		closer, err := makeTempFile(file, text.String())
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		text.WriteString(strings.Repeat("Extra line\n", 50))
+		if _, err = makeTempFile(file, text.String()); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		// Uncompresses the deltas and returns their compressions
+		uncompressDeltas := func() []compression {
+			compressions := make([]compression, 0, 1)
+			_ = fhd.db.Update(func(tx *bolt.Tx) error {
+				blobs := tx.Bucket(blobsBucket)
+				return blobs.ForEach(func(rawSha, raw []byte) error {
+					blobVal := unmarshalBlobVal(raw)
+					if blobVal.Compression != deltaCompression {
+						return nil
+					}
+					deltaVal, _ := unmarshalDeltaVal(blobVal.Blob)
+					compressions = append(compressions,
+						deltaVal.Compression)
+					var delta bytes.Buffer
+					if err := decompress(&delta, deltaVal.Compression,
+						deltaVal.Delta); err != nil {
+						return err
+					}
+					deltaVal.Compression = noCompression
+					deltaVal.Delta = delta.Bytes()
+					blobVal.Blob = deltaVal.marshal()
+					return blobs.Put(rawSha, blobVal.marshal())
+				})
+			})
+			return compressions
+		}
+		if deltas := uncompressDeltas(); len(deltas) != 1 {
+			t.Errorf("expected 1 delta, got %d", len(deltas))
+		}
+		if result, err = fhd.Recompress(RecompressOptions{}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if result.Recompressed == 0 || result.Saved() <= 0 {
+			t.Errorf("expected the delta to be recompressed, got %s",
+				result)
+		}
+		// Deltas are recompressed with the given codecs too
+		uncompressDeltas()
+		if _, err = fhd.Recompress(RecompressOptions{
+			CodecIds: []byte{CodecLzw}}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if deltas := uncompressDeltas(); len(deltas) != 1 ||
+			deltas[0] != compression(CodecLzw) {
+			t.Errorf("expected 1 LZW delta, got %v", deltas)
+		}
+		if _, err = fhd.Recompress(RecompressOptions{}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		var buffer bytes.Buffer
+		if err = fhd.Extract(file, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if buffer.String() != text.String() {
+			t.Errorf("%s: extracted content doesn't match", file)
+		}
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(os.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp18.fhd"
+	fhd, err := New(filename)
+	defer func() { _ = fhd.Close() }()
+	defer func() { os.Remove(filename) }()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else {
+		file := "file18.txt"
+		closer, err := makeTempFile(file, "version one\n")
+		defer closer()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		then := time.Now().Add(-time.Hour)
+		if err = os.Chtimes(file, then, then); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Monitor(file); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		// Same size, mtime, inode, and mode: so not even read
+		if _, err = makeTempFile(file, "version two\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = os.Chtimes(file, then, then); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		saveResult, err := fhd.Save("")
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if !saveResult.NoChanges {
+			t.Errorf("expected no changes, got %s", &saveResult.SaveInfoItem)
+		}
+		if fhd.Paranoid() {
+			t.Error("expected not paranoid by default")
+		}
+		if err = fhd.SetParanoid(true); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.NoChanges || saveResult.Sid != 2 {
+			t.Errorf("expected save #2, got %s", &saveResult.SaveInfoItem)
+		}
+		if err = fhd.SetParanoid(false); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		later := then.Add(time.Minute)
+		if _, err = makeTempFile(file, "version 3\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err = os.Chtimes(file, later, later); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if saveResult.NoChanges || saveResult.Sid != 3 {
+			t.Errorf("expected save #3, got %s", &saveResult.SaveInfoItem)
+		}
+	}
+}
+
+// Saving unchanged files (paranoid, so every file is read and hashed):
+// with hashing first nothing is compressed.
+func BenchmarkSaveUnchanged(b *testing.B) {
+	filenames, cleanup := benchmarkDir(b)
+	defer cleanup()
+	fhd, err := New("bench.fhd")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	if err = fhd.SetParanoid(true); err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(filenames...); err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = fhd.Save(""); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// What an unchanged file costs now: read and hash.
+func BenchmarkUnchangedHashOnly(b *testing.B) {
+	filenames, cleanup := benchmarkDir(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, filename := range filenames {
+			if _, _, err := getRaw(filename); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+}
+
+// What an unchanged file used to cost: read, hash, and compress twice.
+func BenchmarkUnchangedHashAndCompress(b *testing.B) {
+	filenames, cleanup := benchmarkDir(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, filename := range filenames {
+			raw, _, err := getRaw(filename)
+			if err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+			_, _ = compressWith(raw, defaultCodecIds)
+		}
+	}
+}
+
+// Copies tdata's files into a temporary folder and makes it current.
+func benchmarkDir(b *testing.B) ([]string, func()) {
+	dir, err := os.Getwd()
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	temp := b.TempDir()
+	filenames := make([]string, 0)
+	for i := 1; i < 9; i++ {
+		entries, err := os.ReadDir(filepath.Join("tdata", strconv.Itoa(i)))
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		for _, entry := range entries {
+			filename := fmt.Sprintf("%d-%s", i, entry.Name())
+			if err = copyFile(filepath.Join(temp, filename), filepath.Join(
+				"tdata", strconv.Itoa(i), entry.Name())); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+			filenames = append(filenames, filename)
+		}
+	}
+	_ = os.Chdir(temp)
+	return filenames, func() { _ = os.Chdir(dir) }
+}
+
+func TestParallelSave(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	serial, err := New("serial.fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = serial.Close() }()
+	serial.SetMaxWorkers(1)
+	parallel, err := New("parallel.fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = parallel.Close() }()
+	parallel.SetMaxWorkers(8)
+	if parallel.MaxWorkers() != 8 {
+		t.Errorf("expected 8 workers, got %d", parallel.MaxWorkers())
+	}
+	files := make([]string, 0)
+	for i := 0; i < 40; i++ {
+		file := fmt.Sprintf("file19-%02d.txt", i)
+		// Some files have the same content
+		if _, err = makeTempFile(file, strings.Repeat(fmt.Sprintf(
+			"line %d\n", i%7), 50+i%7)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		files = append(files, file)
+	}
+	for _, fhd := range []*Fhd{serial, parallel} {
+		if _, err = fhd.Monitor(files...); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	for i, file := range files {
+		if i%3 == 0 {
+			if _, err = makeTempFile(file, strings.Repeat(fmt.Sprintf(
+				"line %d\n", i%5), 60)); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		} else if i%10 == 1 {
+			os.Remove(file)
+		}
+	}
+	for _, fhd := range []*Fhd{serial, parallel} {
+		if _, err = fhd.Save("changes"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	var serialDump, parallelDump strings.Builder
+	if err = serial.DumpTo(&serialDump); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = parallel.DumpTo(&parallelDump); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if normalized(serialDump.String()) !=
+		normalized(parallelDump.String()) {
+		t.Errorf("parallel save doesn't match serial save:\n%s\n%s",
+			serialDump.String(), parallelDump.String())
+	}
+}
+
+func TestChunked(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	fhd, err := New("temp20.fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	if threshold := fhd.ChunkThreshold(); threshold != defaultChunkThreshold {
+		t.Errorf("expected default threshold, got %d", threshold)
+	}
+	if err = fhd.SetChunkThreshold(1000); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	file := "file20.txt"
+	var text strings.Builder
+	for i := 0; text.Len() < 2*chunkSize+100; i++ {
+		text.WriteString(fmt.Sprintf("This is line #%d\n", i))
+	}
+	versions := []string{text.String(), text.String() + "One more line\n"}
+	if _, err = makeTempFile(file, versions[0]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(file); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(file, versions[1]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Save(""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkChunks(t, fhd, 6)
+	for i, version := range versions {
+		var buffer bytes.Buffer
+		if err = fhd.ExtractForSid(SID(i+1), file, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if buffer.String() != version {
+			t.Errorf("sid #%d: extracted version doesn't match", i+1)
+		}
+	}
+	if _, err = makeTempFile(file, "Short\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Save(""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = fhd.Delete(3, file); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if states, err := fhd.States(); err != nil || len(states) != 1 {
+		t.Errorf("expected one state, got %v %v", states, err)
+	} else if state := states[0]; state.LastSid != 2 ||
+		state.FileKind != txtKind {
+		t.Errorf("expected %s#2:T, got %s", file, state)
+	}
+	if err = fhd.Delete(1, file); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkChunks(t, fhd, 3)
+	if _, err = makeTempFile(file, versions[1]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	generation, _ := fhd.Generation()
+	if saveResult, err := fhd.Save(""); err != nil || !saveResult.NoChanges {
+		t.Errorf("expected no changes, got %v %v", saveResult, err)
+	}
+	if actual, _ := fhd.Generation(); actual != generation {
+		t.Errorf("expected generation %d, got %d", generation, actual)
+	}
+	copies := []string{"file20b.txt", "file20c.txt"}
+	for _, copy := range copies {
+		if _, err = makeTempFile(copy, versions[0]); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if _, err = fhd.Monitor(copies...); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkChunks(t, fhd, 6)
+	for _, copy := range copies {
+		var buffer bytes.Buffer
+		if err = fhd.Extract(copy, &buffer); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if buffer.String() != versions[0] {
+			t.Errorf("%s: extracted content doesn't match", copy)
+		}
+	}
+	// Chunks left by a save that never committed are deleted on opening
+	orphan := shA256(sha256.Sum256([]byte("orphan")))
+	if err = fhd.db.Update(func(tx *bolt.Tx) error {
+		chunks := tx.Bucket(chunksBucket)
+		for index := uint32(0); index < 2; index++ {
+			if err := chunks.Put(chunkKey(orphan, index),
+				[]byte{byte(noCompression)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkChunks(t, fhd, 8)
+	if err = fhd.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if fhd, err = New("temp20.fhd"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkChunks(t, fhd, 6)
+	for _, copy := range copies {
+		var buffer bytes.Buffer
+		if err = fhd.Extract(copy, &buffer); err != nil ||
+			buffer.String() != versions[0] {
+			t.Errorf("%s: extracted content doesn't match: %v", copy, err)
+		}
+	}
+}
+
+func TestStoreBlob(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	fhd, err := New("temp20b.fhd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	fileA := "file20a.txt"
+	fileB := "file20b.txt"
+	content := strings.Repeat("shared content\n", 100)
+	for _, file := range []string{fileA, fileB} {
+		if _, err = makeTempFile(file, content); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if _, err = fhd.Monitor(fileA); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	// fileB's content is already stored so only its SHA256 is kept...
+	stateItem := newState(fileB, newStateVal(InvalidSID, true, txtKind))
+	file := fhd.prepareFiles(context.Background(),
+		[]*StateItem{stateItem}, nil)[0]
+	if file.err != nil || file.blobVal != nil {
+		t.Fatalf("expected no blobVal, got %v: %v", file.blobVal, file.err)
+	}
+	// ...and if that content is purged meanwhile fileB is reread
+	if err = fhd.Purge(fileA, false); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = fhd.update(func(tx *bolt.Tx) error {
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
+		}
+		if found, err := file.storeBlob(tx, blobs); err != nil || found {
+			return fmt.Errorf("expected a new blob: %v", err)
+		}
+		raw, err := blobContent(blobs, file.sha)
+		if err == nil && string(raw) != content {
+			err = errors.New("stored content doesn't match")
+		}
+		return err
+	}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	// ...unless it has changed
+	if _, err = makeTempFile(fileB, "changed\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = fhd.update(func(tx *bolt.Tx) error {
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
+		}
+		if err = blobs.Delete(file.sha[:]); err != nil {
+			return err
+		}
+		_, err = file.storeBlob(tx, blobs)
+		return err
+	}); err == nil {
+		t.Error("expected error storing a changed file")
+	}
+}
+
+func checkChunks(t *testing.T, fhd *Fhd, expected int) {
+	_ = fhd.db.View(func(tx *bolt.Tx) error {
+		_ = tx.Bucket(blobsBucket).ForEach(func(_, raw []byte) error {
+			if compression := unmarshalBlobVal(
+				raw).Compression; compression != chunkedCompression {
+				t.Errorf("expected chunked blob, got %s", compression)
+			}
+			return nil
+		})
+		if actual := tx.Bucket(chunksBucket).Stats().KeyN; actual !=
+			expected {
+			t.Errorf("expected %d chunks, got %d", expected, actual)
+		}
+		return nil
+	})
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp21.fhd"
+	fhd, err := New(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	file1 := "file21a.txt"
+	file2 := "file21b.txt"
+	for _, file := range []string{file1, file2} {
+		if _, err = makeTempFile(file, file+"\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if _, err = fhd.Monitor(file1, file2); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	for i := 0; i < 4; i++ { // #2 #3 #4 #5
+		file := file1
+		if i%2 == 1 {
+			file = file2
+		}
+		if _, err = makeTempFile(file, fmt.Sprintf("%s %d\n", file,
+			i)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	checkSids(t, fhd, file1, []SID{4, 2, 1})
+	checkSids(t, fhd, file2, []SID{5, 3, 1})
+	if err = fhd.Delete(4, file1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkSids(t, fhd, file1, []SID{2, 1})
+	if stateVal, _ := fhd.StateForFilename(file1); stateVal.LastSid != 2 {
+		t.Errorf("expected last SID #2, got #%d", stateVal.LastSid)
+	}
+	if err = fhd.Purge(file2, false); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkSids(t, fhd, file2, []SID{})
+	// Older .fhd files have no history so it is rebuilt on opening
+	if err = fhd.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(historyBucket)
+	}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = fhd.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if fhd, err = New(filename); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkSids(t, fhd, file1, []SID{2, 1})
+	checkSids(t, fhd, file2, []SID{})
+}
+
+func checkSids(t *testing.T, handle Handle, filename string,
+	expected []SID) {
+	sids, err := handle.SidsForFilename(filename)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if !slices.Equal(sids, expected) {
+		t.Errorf("%s: expected SIDs %v, got %v", filename, expected, sids)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp22.fhd"
+	if _, err = NewWithOptions(filename,
+		Options{ReadOnly: true}); err == nil {
+		t.Error("expected error opening a missing file read-only")
+	}
+	fhd, err := New(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	file := "file22.txt"
+	if _, err = makeTempFile(file, "read-only\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(file); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	options := Options{ReadOnly: true, Timeout: 50 * time.Millisecond}
+	if _, err = NewWithOptions(filename, options); !errors.Is(err,
+		ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	if err = fhd.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	reader1, err := NewWithOptions(filename, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = reader1.Close() }()
+	reader2, err := NewWithOptions(filename, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = reader2.Close() }()
+	if !reader1.ReadOnly() {
+		t.Error("expected read-only")
+	}
+	if states, err := reader2.States(); err != nil || len(states) != 1 {
+		t.Errorf("expected 1 state, got %d: %v", len(states), err)
+	}
+	checkSids(t, reader1, file, []SID{1})
+	var buffer bytes.Buffer
+	if err = reader2.Extract(file, &buffer); err != nil ||
+		buffer.String() != "read-only\n" {
+		t.Errorf("unexpected extract %q: %v", buffer.String(), err)
+	}
+	if _, err = makeTempFile(file, "changed\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = reader1.Save(""); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if err = reader1.Ignore(IgnoreItem{Pattern: "*.txt",
+		IgnoreKind: IgnoreGlob}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if _, _, err = reader2.Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err = reader2.Restore(1, file); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	checkSids(t, reader2, file, []SID{1})
+}
+
+func TestBroker(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp23.fhd"
+	broker, err := NewBroker(filename, BrokerOptions{
+		SocketPath: "temp23.sock", IdleTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	served := make(chan error)
+	go func() { served <- broker.Serve() }()
+	if _, err = NewWithOptions(filename, Options{
+		Timeout: 50 * time.Millisecond}); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	var handle1, handle2 Handle
+	if handle1, err = NewClient(broker.SocketPath()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if handle2, err = NewClient(broker.SocketPath()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	file := "file23.txt"
+	if _, err = makeTempFile(file, "one\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	saveResult, err := handle1.Monitor(file) // #1
+	if err != nil || saveResult.Sid != 1 {
+		t.Errorf("expected save #1, got %v: %v", saveResult, err)
+	}
+	if _, err = makeTempFile(file, "two\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if saveResult, err = handle2.Save("second"); err != nil ||
+		saveResult.Sid != 2 || saveResult.Comment != "second" {
+		t.Errorf("expected save #2, got %v: %v", saveResult, err)
+	}
+	checkSids(t, handle1, file, []SID{2, 1})
+	var buffer bytes.Buffer
+	if err = handle1.ExtractForSid(1, file, &buffer); err != nil ||
+		buffer.String() != "one\n" {
+		t.Errorf("unexpected extract %q: %v", buffer.String(), err)
+	}
+	if diff, err := handle2.Diff(file, 1, 2); err != nil ||
+		diff.IsSame() || len(diff.ALines) != 1 {
+		t.Errorf("unexpected diff %v: %v", diff, err)
+	}
+	if states, err := handle2.States(); err != nil || len(states) != 1 ||
+		states[0].Filename != file || states[0].LastSid != 2 {
+		t.Errorf("unexpected states %v: %v", states, err)
+	}
+	if err = handle1.Delete(7, file); err == nil {
+		t.Error("expected error deleting from a missing save")
+	}
+	// Clients (and the Broker) may be in a different folder
+	if err = os.Mkdir("sub", 0o700); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	_ = os.Chdir("sub")
+	bigFile := "big23.txt"
+	big := strings.Repeat("A line of text to stream\n", 3*brokerDataSize/25)
+	if _, err = makeTempFile(bigFile, big); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile("../"+file, "three\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if saveResult, err = handle1.Monitor(bigFile); err != nil ||
+		saveResult.Sid != 3 || len(saveResult.MissingFiles) > 0 {
+		t.Errorf("expected save #3, got %v: %v", saveResult, err)
+	}
+	checkSids(t, handle2, filepath.Join("..", file), []SID{3, 2, 1})
+	checkSids(t, handle2, bigFile, []SID{3})
+	if statusItems, err := handle1.StatusContext(
+		context.Background()); err != nil || len(statusItems) != 2 ||
+		statusItems[0].FileStatus != StatusUnchanged {
+		t.Errorf("unexpected status %v: %v", statusItems, err)
+	}
+	if unaccounted, err := handle2.UnaccountedContext(
+		context.Background()); err != nil || !unaccounted.IsEmpty() {
+		t.Errorf("unexpected unaccounted %v: %v", unaccounted, err)
+	}
+	// Partial results come back with the error
+	if err = os.MkdirAll(filepath.Join("snap", file, "blocker"),
+		0o700); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if filenames, err := handle1.RestoreSnapshot(3, "snap",
+		true); err == nil || !slices.Equal(filenames,
+		[]string{filepath.Join("sub", bigFile)}) {
+		t.Errorf("expected [%s] and an error, got %v: %v", bigFile,
+			filenames, err)
+	}
+	buffer.Reset()
+	if err = handle2.Extract(bigFile, &buffer); err != nil ||
+		buffer.String() != big {
+		t.Errorf("unexpected extract of %d bytes: %v", buffer.Len(), err)
+	}
+	_ = os.Chdir("..")
+	for _, handle := range []Handle{handle1, handle2} {
+		if err = handle.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker failed to shut down when idle")
+	}
+	handle, err := Open(filename, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = handle.Close() }()
+	if _, ok := handle.(*Fhd); !ok {
+		t.Errorf("expected *Fhd, got %T", handle)
+	}
+	checkSids(t, handle, file, []SID{3, 2, 1})
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp24.fhd"
+	fhd, err := New(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	generation, err := fhd.Generation()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := fhd.Watch(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	file := "file24.txt"
+	if _, err = makeTempFile(file, "watched\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(file); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkWatch(t, events, WatchMonitor, WatchSave)
+	if err = fhd.Ignore(IgnoreItem{Pattern: "*.log",
+		IgnoreKind: IgnoreGlob}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkWatch(t, events, WatchIgnore)
+	if err = fhd.SetParanoid(true); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkWatch(t, events, WatchOther)
+	if newGeneration, err := fhd.Generation(); err != nil ||
+		newGeneration <= generation {
+		t.Errorf("expected generation > %d, got %d: %v", generation,
+			newGeneration, err)
+	}
+	// Compact closes and reopens the .fhd file which mustn't disturb saves
+	// or watching
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, _, err := fhd.Compact(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := fhd.watchSnapshot(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ { // #2 #3 #4 #5 #6
+		if _, err = makeTempFile(file, fmt.Sprintf("watched %d\n",
+			i)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = fhd.Save(""); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	checkSids(t, fhd, file, []SID{6, 5, 4, 3, 2, 1})
+	cancel()
+	for range events { // Wait for the channel to be closed
+	}
+}
+
+func checkWatch(t *testing.T, events <-chan WatchEvent,
+	expected ...WatchKind) {
+	for _, kind := range expected {
+		select {
+		case event := <-events:
+			if event.Kind != kind {
+				t.Errorf("expected %s event, got %s", kind, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("expected %s event, got none", kind)
+			return
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp25.fhd"
+	fhd, err := New(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer func() { _ = fhd.Close() }()
+	file := "file25.txt"
+	content := strings.Repeat("All work and no play makes Jack a dull boy.\n",
+		10000)
+	if _, err = makeTempFile(file, content); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = fhd.MonitorContext(cancelled, file); !errors.Is(err,
+		context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, err = fhd.Monitor(file); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(file, content+"more\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	if _, err = fhd.SaveContext(expired, ""); !errors.Is(err,
+		context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	checkSids(t, fhd, file, []SID{1})
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &cancellingWriter{cancel: cancel}
+	if err = fhd.ExtractContext(ctx, file, writer); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if writer.size == 0 || writer.size >= len(content) {
+		t.Errorf("expected a partial extract, got %d bytes", writer.size)
+	}
+	if _, err = fhd.RecompressContext(cancelled,
+		RecompressOptions{}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	before, after, err := fhd.CompactContext(cancelled)
+	if err != context.Canceled || before != after {
+		t.Errorf("expected unchanged size and context.Canceled, got "+
+			"%d→%d: %v", before, after, err)
+	}
+	if gong.FileExists(filename + compactSuffix) {
+		t.Errorf("expected %s to be removed", filename+compactSuffix)
+	}
+	if _, err = fhd.Save(""); err != nil { // #2
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkSids(t, fhd, file, []SID{2, 1})
+}
+
+// Cancels its context once it has been written to.
+type cancellingWriter struct {
+	cancel context.CancelFunc
+	size   int
+}
+
+func (me *cancellingWriter) Write(raw []byte) (int, error) {
+	me.cancel()
+	me.size += len(raw)
+	return len(raw), nil
+}
+
+func TestBrokerCancel(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	broker, err := NewBroker("temp26.fhd", BrokerOptions{
+		SocketPath: "temp26.sock"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	served := make(chan error)
+	go func() { served <- broker.Serve() }()
+	client, err := NewClient(broker.SocketPath())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	files := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		file := fmt.Sprintf("file26-%02d.txt", i)
+		if _, err = makeTempFile(file, strings.Repeat(file+"\n",
+			20000)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		files = append(files, file)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = client.MonitorContext(cancelled, files...); !errors.Is(err,
+		context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	// The Monitor may or may not finish before it is cancelled, but either
+	// way the Client must still work afterwards.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond)
+	defer cancel()
+	saveResult, err := client.MonitorContext(ctx, files...)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	sids, err := client.Sids()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if saveResult.Sid.IsValid() && !slices.Equal(sids, []SID{1}) {
+		t.Errorf("expected SIDs [1], got %v", sids)
+	}
+	if _, err = client.Monitor(files...); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if sid := client.Sid(); sid != 1 {
+		t.Errorf("expected SID #1, got #%d", sid)
+	}
+	if err = client.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = broker.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = <-served; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = gong.AbsPath(".")
+	}
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(dir) }()
+	filename := "temp27.fhd"
+	events := make([]ProgressEvent, 0)
+	fhd, err := NewWithOptions(filename, Options{
+		Progress: func(event ProgressEvent) {
+			events = append(events, event)
+		}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	file1 := "file27a.txt"
+	file2 := "file27b.txt"
+	var totalBytes int64
+	for _, file := range []string{file1, file2} {
+		content := strings.Repeat(file+"\n", 100)
+		if _, err = makeTempFile(file, content); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		totalBytes += int64(len(content))
+	}
+	if _, err = makeTempFile("ignored27.tmp", "ignored\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = fhd.Monitor(file1, file2, "missing27.txt",
+		"ignored27.tmp"); err != nil { // #1
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkProgress(t, events, map[ProgressKind]int{ProgressMissing: 1,
+		ProgressIgnored: 1, ProgressStarted: 2, ProgressHashed: 2,
+		ProgressStored: 2})
+	last := events[len(events)-1]
+	if last.Files != 4 || last.TotalFiles != 4 ||
+		last.Bytes != totalBytes || last.TotalBytes != totalBytes {
+		t.Errorf("unexpected final event %s", last)
+	}
+	for _, event := range events {
+		if event.Kind == ProgressStored && (event.Codec != CodecFlate ||
+			event.Size == 0 || event.Size >= totalBytes/2) {
+			t.Errorf("unexpected stored event %s", event)
+		}
+	}
+	events = events[:0]
+	if _, err = fhd.Save(""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if last := events[len(events)-1]; last.Files != 2 ||
+		last.TotalFiles != 2 {
+		t.Errorf("unexpected final event %s", last)
+	}
+	for _, event := range events {
+		if event.Kind == ProgressStored {
+			t.Errorf("unexpected stored event %s", event)
+		}
+	}
+	events = events[:0]
+	if _, err = makeTempFile(file1, "changed\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	callEvents := make([]ProgressEvent, 0)
+	if _, err = fhd.SaveContext(WithProgress(context.Background(),
+		func(event ProgressEvent) {
+			callEvents = append(callEvents, event)
+		}), ""); err != nil { // #2
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+	checkProgress(t, callEvents, map[ProgressKind]int{ProgressStarted: 2,
+		ProgressStored: 1, ProgressUnchanged: 1})
+	// Files are only reported stored once the save is committed, so
+	// cancelling then is too late to roll it back
+	for _, file := range []string{file1, file2} {
+		if _, err = makeTempFile(file, file+" changed\n"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	callEvents = callEvents[:0]
+	if saveResult, err := fhd.SaveContext(WithProgress(ctx,
+		func(event ProgressEvent) {
+			callEvents = append(callEvents, event)
+			if event.Kind == ProgressStored {
+				cancel()
+			}
+		}), ""); err != nil || saveResult.Sid != 3 { // #3
+		t.Errorf("expected save #3, got %v: %v", saveResult, err)
+	}
+	checkProgress(t, callEvents, map[ProgressKind]int{ProgressStarted: 2,
+		ProgressStored: 2})
+	if err = fhd.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	broker, err := NewBroker(filename, BrokerOptions{
+		SocketPath: "temp27.sock"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	served := make(chan error)
+	go func() { served <- broker.Serve() }()
+	client, err := NewClient(broker.SocketPath())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = makeTempFile(file2, "changed\n"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	callEvents = callEvents[:0]
+	if _, err = client.SaveContext(WithProgress(context.Background(),
+		func(event ProgressEvent) {
+			callEvents = append(callEvents, event)
+		}), ""); err != nil { // #4
+		t.Errorf("unexpected error: %s", err)
+	}
+	checkProgress(t, callEvents, map[ProgressKind]int{ProgressStarted: 2,
+		ProgressStored: 1, ProgressUnchanged: 1})
+	if err = client.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = broker.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err = <-served; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Checks that there are the expected numbers of events of each kind (which
+// must include every kind there is an event for other than ProgressHashed
+// since whether files are hashed depends on their stat data).
+func checkProgress(t *testing.T, events []ProgressEvent,
+	expected map[ProgressKind]int) {
+	counts := make(map[ProgressKind]int)
+	for _, event := range events {
+		counts[event.Kind]++
+	}
+	if _, ok := expected[ProgressHashed]; !ok {
+		delete(counts, ProgressHashed)
+	}
+	if !maps.Equal(counts, expected) {
+		t.Errorf("expected event counts %v, got %v", expected, counts)
+	}
+}
+
+func checkBlobRefs(t *testing.T, fhd *Fhd, expected []uint32) {
+	refs := make([]uint32, 0)
+	_ = fhd.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobsBucket).ForEach(func(_, raw []byte) error {
+			refs = append(refs, unmarshalBlobVal(raw).Refs)
+			return nil
+		})
+	})
+	slices.Sort(refs)
+	if !slices.Equal(refs, expected) {
+		t.Errorf("expected blob refs %v, got %v", expected, refs)
+	}
+}
+
 func removeFhds(filename string) {
 	for i := 1; i < 9; i++ {
 		os.Remove("tdata/" + strconv.Itoa(i) + "/" + filename)
@@ -672,8 +3201,9 @@ func normalized(text string) string {
 
 const (
 	expected1 = `config
-  format=1
-  ignore= "*#[0-9].*" "*.a" "*.bak" "*.class" "*.dll" "*.exe" "*.fhd" "*.jar" "*.ld" "*.ldx" "*.li" "*.lix" "*.o" "*.obj" "*.py[co]" "*.rs.bk" "*.so" "*.sw[nop]" "*.swp" "*.tmp" "*~" "gpl-[0-9].[0-9].txt" "louti[0-9]*" "moc_*.cpp" "qrc_*.cpp" "ui_*.h"
+  format=2
+  ignore= "*#[0-9].*"g "*.a"g "*.bak"g "*.class"g "*.dll"g "*.exe"g "*.fhd"g "*.jar"g "*.ld"g "*.ldx"g "*.li"g "*.lix"g "*.o"g "*.obj"g "*.py[co]"g "*.rs.bk"g "*.so"g "*.sw[nop]"g "*.swp"g "*.tmp"g "*~"g ".*"g ".?*"d "gpl-[0-9].[0-9].txt"g "louti[0-9]*"g "moc_*.cpp"g "qrc_*.cpp"g "ui_*.h"g
+  codecs= "*.7z"U "*.bz2"U "*.docx"U "*.gif"U "*.gz"U "*.jpeg"U "*.jpg"U "*.mp3"U "*.mp4"U "*.odp"U "*.ods"U "*.odt"U "*.png"U "*.pptx"U "*.webp"U "*.xlsx"U "*.xz"U "*.zip"U
 states:
   battery.png M#1:I
   computer.bmp M#1:I
@@ -4,8 +4,13 @@
 package fhd
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -14,33 +19,20 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-func newDb(filename string) (*bolt.DB, error) {
-	db, err := bolt.Open(filename, gong.ModeUserRW, nil)
+func newDb(filename string, options Options) (*bolt.DB, error) {
+	db, err := bolt.Open(filename, gong.ModeUserRW, &bolt.Options{
+		ReadOnly: options.ReadOnly, Timeout: options.Timeout})
 	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("%w: %s", ErrBusy, filename)
+		}
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		err := makeConfig(tx)
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(statesBucket)
-		if err != nil {
-			return fmt.Errorf("failed to create bucket %q: %s",
-				statesBucket, err)
-		}
-		_, err = tx.CreateBucketIfNotExists(savesBucket)
-		if err != nil {
-			return fmt.Errorf("failed to create bucket %q: %s", savesBucket,
-				err)
-		}
-		_, err = tx.CreateBucketIfNotExists(saveInfoBucket)
-		if err != nil {
-			return fmt.Errorf("failed to create bucket %q: %s",
-				saveInfoBucket, err)
-		}
-		return nil
-	})
+	if options.ReadOnly {
+		err = db.View(checkUpToDate)
+	} else {
+		err = db.Update(initialize)
+	}
 	if err != nil {
 		closeErr := db.Close()
 		if closeErr != nil {
@@ -51,6 +43,128 @@ func newDb(filename string) (*bolt.DB, error) {
 	return db, nil
 }
 
+// Every read goes through here so that it can't see db while Compact is
+// closing and reopening it.
+func (me *Fhd) view(fn func(*bolt.Tx) error) error {
+	me.dbLock.RLock()
+	defer me.dbLock.RUnlock()
+	return me.db.View(fn)
+}
+
+// Every change goes through here so that read-only handles refuse them and
+// so that the generation is bumped.
+func (me *Fhd) update(fn func(*bolt.Tx) error) error {
+	if me.options.ReadOnly {
+		return ErrReadOnly
+	}
+	me.dbLock.RLock()
+	defer me.dbLock.RUnlock()
+	return me.db.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return bumpGeneration(tx)
+	})
+}
+
+// Like update but doesn't bump the generation: chunks can only be seen
+// once a save that refers to them is committed (which bumps it).
+func (me *Fhd) updateChunks(fn func(*bolt.Tx) error) error {
+	if me.options.ReadOnly {
+		return ErrReadOnly
+	}
+	me.dbLock.RLock()
+	defer me.dbLock.RUnlock()
+	return me.db.Update(fn)
+}
+
+// Creates any missing buckets and brings older file formats up to date.
+func initialize(tx *bolt.Tx) error {
+	err := makeConfig(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.CreateBucketIfNotExists(statesBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s",
+			statesBucket, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(savesBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s", savesBucket,
+			err)
+	}
+	_, err = tx.CreateBucketIfNotExists(saveInfoBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s",
+			saveInfoBucket, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(blobsBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s",
+			blobsBucket, err)
+	}
+	_, err = tx.CreateBucketIfNotExists(chunksBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s",
+			chunksBucket, err)
+	}
+	if tx.Bucket(historyBucket) == nil {
+		if err = makeHistory(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.CreateBucketIfNotExists(statsBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s",
+			statsBucket, err)
+	}
+	if err = migrate(tx); err != nil {
+		return err
+	}
+	return sweepChunks(tx)
+}
+
+// A read-only .fhd file can't be brought up to date, so it must be current.
+func checkUpToDate(tx *bolt.Tx) error {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return fmt.Errorf("failed to find %q", configBucket)
+	}
+	if format := config.Get(configFormat); len(format) != 1 ||
+		format[0] != fileFormat {
+		return errors.New("the .fhd file's format is out of date: open " +
+			"it read-write to update it")
+	}
+	for _, bucket := range [][]byte{statesBucket, savesBucket,
+		saveInfoBucket, blobsBucket, chunksBucket, historyBucket,
+		statsBucket} {
+		if tx.Bucket(bucket) == nil {
+			return fmt.Errorf("failed to find %q: open the .fhd file "+
+				"read-write to update it", bucket)
+		}
+	}
+	return nil
+}
+
+// Brings older file formats up to date.
+func migrate(tx *bolt.Tx) error {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return fmt.Errorf("failed to find %q", configBucket)
+	}
+	format := config.Get(configFormat)
+	if len(format) != 1 || format[0] >= fileFormat {
+		return nil
+	}
+	if format[0] < 2 {
+		if err := migrateBlobs(tx); err != nil {
+			return fmt.Errorf("failed to migrate to format 2: %s", err)
+		}
+	}
+	return config.Put(configFormat, []byte{fileFormat})
+}
+
 func makeConfig(tx *bolt.Tx) error {
 	config, err := tx.CreateBucketIfNotExists(configBucket)
 	if err != nil {
@@ -69,20 +183,83 @@ func makeConfig(tx *bolt.Tx) error {
 		return fmt.Errorf("failed to create bucket %q: %s",
 			configIgnore, err)
 	}
-	for _, filename := range defaultIgnores {
-		if ierr := ignores.Put([]byte(filename),
-			emptyValue); ierr != nil {
+	for _, pattern := range defaultIgnores {
+		if ierr := putIgnore(ignores, IgnoreItem{Pattern: pattern,
+			IgnoreKind: IgnoreGlob}); ierr != nil {
+			err = errors.Join(err, ierr)
+		}
+	}
+	for _, pattern := range defaultDirIgnores {
+		if ierr := putIgnore(ignores, IgnoreItem{Pattern: pattern,
+			IgnoreKind: IgnoreDirname}); ierr != nil {
+			err = errors.Join(err, ierr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = migrateIgnores(ignores); err != nil {
+		return err
+	}
+	if config.Bucket(configCodecs) == nil {
+		return makeCodecs(config)
+	}
+	return nil
+}
+
+// Creates the codecs bucket with the default uncompressed patterns.
+func makeCodecs(config *bolt.Bucket) error {
+	codecs, err := config.CreateBucket(configCodecs)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s", configCodecs,
+			err)
+	}
+	for _, pattern := range defaultUncompressed {
+		if ierr := putCodecIds(codecs, pattern,
+			[]byte{CodecNone}); ierr != nil {
+			err = errors.Join(err, ierr)
+		}
+	}
+	return err
+}
+
+// Ignores used to have empty values: this gives each such ignore its kind.
+func migrateIgnores(ignores *bolt.Bucket) error {
+	untyped := make([]IgnoreItem, 0)
+	cursor := ignores.Cursor()
+	rawPattern, rawIgnoreKind := cursor.First()
+	for ; rawPattern != nil; rawPattern, rawIgnoreKind = cursor.Next() {
+		if len(rawIgnoreKind) == 0 {
+			untyped = append(untyped, newIgnoreItemFromRaw(rawPattern,
+				rawIgnoreKind))
+		}
+	}
+	var err error
+	for _, ignoreItem := range untyped {
+		if ierr := putIgnore(ignores, ignoreItem); ierr != nil {
 			err = errors.Join(err, ierr)
 		}
 	}
 	return err
 }
 
+func putIgnore(ignores *bolt.Bucket, ignoreItem IgnoreItem) error {
+	if !ignoreItem.IgnoreKind.IsValid() {
+		return fmt.Errorf("invalid ignore kind %q for %q",
+			ignoreItem.IgnoreKind, ignoreItem.Pattern)
+	}
+	return ignores.Put([]byte(ignoreItem.Pattern),
+		[]byte{byte(ignoreItem.IgnoreKind)})
+}
+
+// Returns sets of missing and ignored files, and true if any file is newly
+// monitored.
 func (me *Fhd) monitor(filenames ...string) (gset.Set[string],
-	gset.Set[string], error) {
+	gset.Set[string], bool, error) {
 	missing := gset.New[string]()
 	ignored := gset.New[string]()
-	err := me.db.Update(func(tx *bolt.Tx) error {
+	changed := false
+	err := me.update(func(tx *bolt.Tx) error {
 		states := tx.Bucket(statesBucket)
 		if states == nil {
 			return fmt.Errorf("failed to find %q", statesBucket)
@@ -94,7 +271,7 @@ func (me *Fhd) monitor(filenames ...string) (gset.Set[string],
 		var err error
 		for _, filename := range filenames {
 			filename = me.relativePath(filename)
-			if !gong.FileExists(filename) {
+			if !gong.FileExists(me.diskPath(filename)) {
 				missing.Add(filename)
 				continue // ignore nonexistent files
 			}
@@ -107,9 +284,13 @@ func (me *Fhd) monitor(filenames ...string) (gset.Set[string],
 			rawOldStateVal := states.Get(rawFilename)
 			if rawOldStateVal != nil {
 				stateVal = unmarshalStateVal(rawOldStateVal)
-				stateVal.Monitored = true
+				if !stateVal.Monitored {
+					stateVal.Monitored = true
+					changed = true
+				}
 			} else { // sid will be set in save()
 				stateVal = newStateVal(InvalidSID, true, binKind)
+				changed = true
 			}
 			if ierr := states.Put(rawFilename,
 				stateVal.marshal()); ierr != nil {
@@ -118,25 +299,71 @@ func (me *Fhd) monitor(filenames ...string) (gset.Set[string],
 		}
 		return err
 	})
-	return missing, ignored, err
+	return missing, ignored, changed, err
 }
 
 func (me *Fhd) mustIgnore(ignores *bolt.Bucket, filename string) bool {
-	filename = filepath.Base(filename)
 	cursor := ignores.Cursor()
-	rawPattern, _ := cursor.First()
-	for ; rawPattern != nil; rawPattern, _ = cursor.Next() {
-		if matched, err := filepath.Match(string(rawPattern),
-			filename); matched && err == nil {
+	rawPattern, rawIgnoreKind := cursor.First()
+	for ; rawPattern != nil; rawPattern, rawIgnoreKind = cursor.Next() {
+		if newIgnoreItemFromRaw(rawPattern, rawIgnoreKind).matches(
+			filename) {
 			return true
 		}
 	}
 	return false
 }
 
+func (me *Fhd) mustIgnoreDir(ignores *bolt.Bucket, dirname string) bool {
+	cursor := ignores.Cursor()
+	rawPattern, rawIgnoreKind := cursor.First()
+	for ; rawPattern != nil; rawPattern, rawIgnoreKind = cursor.Next() {
+		if newIgnoreItemFromRaw(rawPattern, rawIgnoreKind).matchesDir(
+			dirname) {
+			return true
+		}
+	}
+	return false
+}
+
+// Walks the .fhd file's folder and subfolders (skipping ignored and
+// unreadable subfolders) adding every regular file that's neither in
+// states nor ignored to unaccounted.
+func (me *Fhd) addUnaccounted(ctx context.Context, states,
+	ignores *bolt.Bucket, unaccounted gset.Set[string]) error {
+	root := filepath.Dir(me.filename)
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry,
+		err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // skip unreadable files and folders
+		}
+		filename, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if filename != "." && me.mustIgnoreDir(ignores, filename) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() && states.Get([]byte(filename)) == nil &&
+			!me.mustIgnore(ignores, filename) {
+			unaccounted.Add(filename)
+		}
+		return nil
+	})
+}
+
 func (me *Fhd) monitored(monitored bool) ([]*StateItem, error) {
 	stateItems := make([]*StateItem, 0)
-	err := me.db.View(func(tx *bolt.Tx) error {
+	err := me.view(func(tx *bolt.Tx) error {
 		states := tx.Bucket(statesBucket)
 		if states == nil {
 			return fmt.Errorf("failed to find %q", statesBucket)
@@ -159,14 +386,37 @@ func (me *Fhd) monitored(monitored bool) ([]*StateItem, error) {
 	return stateItems, nil
 }
 
-func (me *Fhd) save(comment string, missing, ignored gset.Set[string]) (
-	SaveResult, error) {
+func (me *Fhd) save(ctx context.Context, comment string, missing,
+	ignored gset.Set[string], monitorChanged bool) (SaveResult, error) {
 	monitored, err := me.Monitored()
 	if err != nil {
 		return newInvalidSaveResult(), err
 	}
+	return me.saveStateItems(ctx, comment, monitored, missing, ignored,
+		monitorChanged)
+}
+
+// Does a save of those of the given files that have changed. If no file
+// has changed (and monitorChanged is false and no file has become
+// unmonitored), the save is rolled back unless empty saves are to be kept,
+// and the SaveResult has NoChanges set and an invalid SID. If the context
+// is done before the save is committed, the save is rolled back.
+func (me *Fhd) saveStateItems(ctx context.Context, comment string,
+	stateItems []*StateItem, missing, ignored gset.Set[string],
+	monitorChanged bool) (SaveResult, error) {
+	if me.options.ReadOnly {
+		return newInvalidSaveResult(), ErrReadOnly
+	}
+	me.saving.Lock()
+	defer me.saving.Unlock()
+	progress := me.newSaveProgressReporter(ctx, stateItems, missing,
+		ignored)
+	prepared := me.prepareFiles(ctx, stateItems, progress)
 	var saveResult SaveResult
-	err = me.db.Update(func(tx *bolt.Tx) error {
+	err := me.update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var err error
 		states := tx.Bucket(statesBucket)
 		if states == nil {
@@ -200,30 +450,76 @@ func (me *Fhd) save(comment string, missing, ignored gset.Set[string]) (
 			return fmt.Errorf("failed to save metadata for #%d", sid)
 		}
 		count := 0
-		for _, stateItem := range monitored {
-			saved, ierr := me.saveOrUnmonitorOne(&saveResult, stateItem, tx,
-				saves, save, sid, states, ignores)
+		for _, file := range prepared {
+			if err := ctx.Err(); err != nil {
+				return err // roll back
+			}
+			changed, ierr := me.saveOrUnmonitorOne(&saveResult, file, tx,
+				save, sid, states, ignores)
 			if ierr != nil {
 				err = errors.Join(err, ierr)
 			}
-			if saved {
+			if changed {
 				count++
 			}
 		}
+		if err == nil && count == 0 && !monitorChanged &&
+			!getConfigFlag(tx, configKeepEmpty) {
+			return errNoChanges // roll back
+		}
 		if err == nil {
 			err = me.saveInfoItem(tx, saveResult.SaveInfoItem)
 		}
 		return err
 	})
+	if err == nil {
+		for _, file := range prepared {
+			file.reportStored()
+		}
+	} else if ierr := me.deleteOrphanChunks(prepared); ierr != nil {
+		err = errors.Join(err, ierr)
+	}
+	if errors.Is(err, errNoChanges) {
+		saveResult.Sid = InvalidSID
+		saveResult.NoChanges = true
+		err = nil
+	}
 	return saveResult, err
 }
 
+// Returns a progress reporter for the given files (or nil if progress
+// isn't wanted) having reported the missing and ignored files.
+func (me *Fhd) newSaveProgressReporter(ctx context.Context,
+	stateItems []*StateItem,
+	missing, ignored gset.Set[string]) *progressReporter {
+	progress := me.newProgressReporter(ctx,
+		len(stateItems)+len(missing)+len(ignored), 0)
+	if progress == nil {
+		return nil
+	}
+	for _, stateItem := range stateItems {
+		if info, err := os.Stat(me.diskPath(
+			stateItem.Filename)); err == nil {
+			progress.totalBytes += info.Size()
+		}
+	}
+	for _, filename := range gong.SortedMapKeys(missing) {
+		progress.report(ProgressMissing, filename, 0, 0)
+	}
+	for _, filename := range gong.SortedMapKeys(ignored) {
+		progress.report(ProgressIgnored, filename, 0, 0)
+	}
+	return progress
+}
+
 func (me *Fhd) unmonitor(states, ignores *bolt.Bucket,
 	filename string) error {
-	rawFilename := []byte(me.relativePath(filename))
+	filename = me.relativePath(filename)
+	rawFilename := []byte(filename)
 	rawOldStateVal := states.Get(rawFilename)
 	if rawOldStateVal == nil { // Not Monitored so add to ignores
-		return ignores.Put(rawFilename, emptyValue)
+		return putIgnore(ignores, IgnoreItem{Pattern: filename,
+			IgnoreKind: IgnoreFilename})
 	} else {
 		stateVal := unmarshalStateVal(rawOldStateVal)
 		stateVal.Monitored = false
@@ -231,6 +527,28 @@ func (me *Fhd) unmonitor(states, ignores *bolt.Bucket,
 	}
 }
 
+// Returns true if the given config key's value is set to true.
+func getConfigFlag(tx *bolt.Tx, key []byte) bool {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return false
+	}
+	value := config.Get(key)
+	return len(value) == 1 && value[0] == configTrue
+}
+
+func putConfigFlag(tx *bolt.Tx, key []byte, flag bool) error {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return fmt.Errorf("failed to find %q", configBucket)
+	}
+	value := configFalse
+	if flag {
+		value = configTrue
+	}
+	return config.Put(key, []byte{value})
+}
+
 func (me *Fhd) getIgnores(tx *bolt.Tx) *bolt.Bucket {
 	config := tx.Bucket(configBucket)
 	if config == nil {
@@ -239,19 +557,31 @@ func (me *Fhd) getIgnores(tx *bolt.Tx) *bolt.Bucket {
 	return config.Bucket(configIgnore)
 }
 
+// Returns the SID after the highest SID ever used (even if its save has
+// since been purged) and records it as the highest.
 func (me *Fhd) nextSid(tx *bolt.Tx, comment string) (SaveResult, error) {
-	var sid SID
 	saveInfo := tx.Bucket(saveInfoBucket)
 	if saveInfo == nil {
 		return newInvalidSaveResult(), fmt.Errorf("failed to find %q",
 			saveInfoBucket)
 	}
-	cursor := saveInfo.Cursor()
-	rawSid, _ := cursor.Last()
-	if rawSid == nil {
-		sid = 1 // start at 1
-	} else {
-		sid = unmarshalSid(rawSid) + 1
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return newInvalidSaveResult(), fmt.Errorf("failed to find %q",
+			configBucket)
+	}
+	var sid SID // 0 so the first SID is 1
+	if rawSid, _ := saveInfo.Cursor().Last(); rawSid != nil {
+		sid = unmarshalSid(rawSid)
+	}
+	if rawSid := config.Get(configLastSid); rawSid != nil {
+		if lastSid := unmarshalSid(rawSid); lastSid > sid {
+			sid = lastSid
+		}
+	}
+	sid++
+	if err := config.Put(configLastSid, sid.marshal()); err != nil {
+		return newInvalidSaveResult(), err
 	}
 	return newSaveResult(sid, time.Now(), comment), nil
 }
@@ -268,57 +598,113 @@ func (me *Fhd) saveInfoItem(tx *bolt.Tx, saveInfoItem SaveInfoItem) error {
 	return err
 }
 
+// Returns true if the file was saved or unmonitored.
 func (me *Fhd) saveOrUnmonitorOne(saveResult *SaveResult,
-	stateItem *StateItem, tx *bolt.Tx, saves, save *bolt.Bucket,
-	sid SID, states, ignores *bolt.Bucket) (bool, error) {
-	var err error
-	var saved bool
-	if gong.FileExists(stateItem.Filename) { // Save
-		saved, err = me.maybeSaveOne(tx, saves, save, sid,
-			stateItem.Filename, stateItem.LastSid)
+	file *preparedFile, tx *bolt.Tx, save *bolt.Bucket, sid SID, states,
+	ignores *bolt.Bucket) (bool, error) {
+	if file.exists { // Save
+		saved, err := me.saveOne(tx, save, sid, file)
 		if saved {
-			saveResult.MissingFiles.Delete(stateItem.Filename)
+			saveResult.MissingFiles.Delete(file.Filename)
 		}
-	} else { // Unmonitor
-		saveResult.MissingFiles.Add(stateItem.Filename)
-		err = me.unmonitor(states, ignores, stateItem.Filename)
+		return saved, err
 	}
-	return saved, err
+	// Unmonitor
+	file.progress.report(ProgressMissing, file.Filename, 0, 0)
+	saveResult.MissingFiles.Add(file.Filename)
+	err := me.unmonitor(states, ignores, file.Filename)
+	return err == nil, err
 }
 
-// If the new file's SHA256 != prev SHA256 (or there is no prev) we save the
-// file _and_ update the states with the SID for fast access to the file's
-// most recent save.
-func (me *Fhd) maybeSaveOne(tx *bolt.Tx, saves, save *bolt.Bucket, sid SID,
-	filename string, prevSid SID) (bool, error) {
-	var sha shA256
-	raw, rawFlate, rawLzw, err := getRaws(filename, &sha)
+// If the prepared file's SHA256 != prev SHA256 (or there is no prev) we
+// save the file _and_ update the states with the SID for fast access to
+// the file's most recent save.
+func (me *Fhd) saveOne(tx *bolt.Tx, save *bolt.Bucket, sid SID,
+	file *preparedFile) (bool, error) {
+	if file.err != nil {
+		file.progress.report(ProgressFailed, file.Filename, 0, 0)
+		return false, file.err
+	}
+	stats := tx.Bucket(statsBucket)
+	if stats == nil {
+		return false, fmt.Errorf("failed to find %q", statsBucket)
+	}
+	if file.unchanged { // No need to save if same as before.
+		if file.statHit {
+			return false, nil
+		}
+		return false, putStat(stats, file.Filename,
+			newStatVal(file.LastSid, file.info))
+	}
+	blobs, err := getBlobs(tx)
 	if err != nil {
 		return false, err
 	}
-	if me.sameAsPrev(saves, sid, filename, prevSid, &sha) {
-		return false, nil // No need to save if same as before.
+	found, err := file.storeBlob(tx, blobs)
+	if err != nil {
+		file.progress.report(ProgressFailed, file.Filename, 0, 0)
+		return false, err
 	}
-	compression := compressionForSizes(len(raw), len(rawFlate), len(rawLzw))
-	saveVal := newSaveVal(sha, compression)
-	switch compression {
-	case noCompression:
-		saveVal.Blob = raw
-	case flateCompression:
-		saveVal.Blob = rawFlate
-	case lzwCompression:
-		saveVal.Blob = rawLzw
+	file.noteStored(blobs, found)
+	rawFilename := []byte(file.Filename)
+	if err = save.Put(rawFilename,
+		newSaveVal(file.sha).marshal()); err != nil {
+		return true, err
 	}
-	rawFilename := []byte(filename)
-	if err = save.Put(rawFilename, saveVal.marshal()); err != nil {
+	if err = putHistory(tx, rawFilename, sid); err != nil {
 		return true, err
 	}
 	states := tx.Bucket(statesBucket)
 	if states == nil {
 		return true, errors.New("missing states")
 	}
-	stateVal := newStateVal(sid, true, fileKindForRaw(raw))
-	return true, states.Put(rawFilename, stateVal.marshal())
+	stateVal := newStateVal(sid, file.Monitored, file.kind)
+	if err = states.Put(rawFilename, stateVal.marshal()); err != nil {
+		return true, err
+	}
+	return true, putStat(stats, file.Filename, newStatVal(sid, file.info))
+}
+
+// Returns true if the given file's stats value matches statVal (which
+// includes the SID its content was last saved in) and isn't racy.
+func sameStat(stats *bolt.Bucket, filename string, statVal statVal) bool {
+	oldStatVal, ok := unmarshalStatVal(stats.Get([]byte(filename)))
+	return ok && oldStatVal == statVal && !statVal.isRacy(time.Now())
+}
+
+func deleteStat(tx *bolt.Tx, rawFilename []byte) error {
+	stats := tx.Bucket(statsBucket)
+	if stats == nil {
+		return fmt.Errorf("failed to find %q", statsBucket)
+	}
+	return stats.Delete(rawFilename)
+}
+
+// Stores the given file's stat data, unless it was modified so recently
+// that it must be hashed next time anyway.
+func putStat(stats *bolt.Bucket, filename string, statVal statVal) error {
+	if statVal.isRacy(time.Now()) {
+		return stats.Delete([]byte(filename))
+	}
+	return stats.Put([]byte(filename), statVal.marshal())
+}
+
+// Deletes the given file from the given save (with the given SID) and
+// releases its blob.
+func deleteSaveVal(tx *bolt.Tx, save, blobs *bolt.Bucket, sid SID,
+	rawFilename []byte) error {
+	rawSaveVal := save.Get(rawFilename)
+	if rawSaveVal == nil {
+		return nil
+	}
+	saveVal := unmarshalSaveVal(rawSaveVal)
+	if err := save.Delete(rawFilename); err != nil {
+		return err
+	}
+	if err := deleteHistory(tx, rawFilename, sid); err != nil {
+		return err
+	}
+	return releaseBlob(blobs, saveVal.Sha)
 }
 
 func (me *Fhd) sameAsPrev(saves *bolt.Bucket, newSid SID, filename string,
@@ -346,10 +732,568 @@ func (me *Fhd) getSaveVal(saves *bolt.Bucket, filename string,
 	return unmarshalSaveVal(rawSaveVal)
 }
 
+// Must be called after the given file has been deleted from a save to
+// update the file's state to its most recent remaining save. If there are
+// no saves left with the file, its state is deleted and it is ignored.
+func (me *Fhd) updateStateAfterDelete(tx *bolt.Tx, saves *bolt.Bucket,
+	rawFilename []byte) error {
+	states := tx.Bucket(statesBucket)
+	if states == nil {
+		return fmt.Errorf("failed to find %q", statesBucket)
+	}
+	ignores := me.getIgnores(tx)
+	if ignores == nil {
+		return fmt.Errorf("failed to find %q", configIgnore)
+	}
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return err
+	}
+	lastSid, saveVal := me.lastSaveValForFilename(saves, rawFilename)
+	if !lastSid.IsValid() {
+		if err := states.Delete(rawFilename); err != nil {
+			return err
+		}
+		if err := deleteStat(tx, rawFilename); err != nil {
+			return err
+		}
+		return putIgnore(ignores, IgnoreItem{Pattern: string(rawFilename),
+			IgnoreKind: IgnoreFilename})
+	}
+	rawStateVal := states.Get(rawFilename)
+	if rawStateVal == nil {
+		return nil // Should never happen
+	}
+	stateVal := unmarshalStateVal(rawStateVal)
+	if stateVal.LastSid == lastSid {
+		return nil
+	}
+	if stateVal.FileKind, err = blobFileKind(blobs,
+		saveVal.Sha); err != nil {
+		return err
+	}
+	stateVal.LastSid = lastSid
+	return states.Put(rawFilename, stateVal.marshal())
+}
+
+// Returns the most recent SID and saveVal for the given file or InvalidSID
+// and nil if no save has the file.
+func (me *Fhd) lastSaveValForFilename(saves *bolt.Bucket,
+	rawFilename []byte) (SID, *saveVal) {
+	history, err := getHistory(saves.Tx())
+	if err != nil {
+		return InvalidSID, nil
+	}
+	sid := lastSidForFilename(history, rawFilename)
+	if save := saves.Bucket(sid.marshal()); sid.IsValid() && save != nil {
+		if rawSaveVal := save.Get(rawFilename); rawSaveVal != nil {
+			return sid, unmarshalSaveVal(rawSaveVal)
+		}
+	}
+	return InvalidSID, nil
+}
+
+// Deletes the given file from every save that has it, and deletes any save
+// (and its save info) that is left empty. Returns the number of saves the
+// file was deleted from.
+func (me *Fhd) purge(tx *bolt.Tx, rawFilename []byte) (int, error) {
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return 0, fmt.Errorf("failed to find %q", savesBucket)
+	}
+	saveInfo := tx.Bucket(saveInfoBucket)
+	if saveInfo == nil {
+		return 0, fmt.Errorf("failed to find %q", saveInfoBucket)
+	}
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return 0, err
+	}
+	history, err := getHistory(tx)
+	if err != nil {
+		return 0, err
+	}
+	sids := sidsForFilename(history, rawFilename)
+	purged := gset.New[shA256]()
+	for _, sid := range sids {
+		if save := saves.Bucket(sid.marshal()); save != nil {
+			if rawSaveVal := save.Get(rawFilename); rawSaveVal != nil {
+				purged.Add(unmarshalSaveVal(rawSaveVal).Sha)
+			}
+		}
+	}
+	// Other files' blobs may be deltas against this file's
+	if err = undeltaBlobs(blobs, purged); err != nil {
+		return 0, err
+	}
+	for _, sid := range sids {
+		rawSid := sid.marshal()
+		save := saves.Bucket(rawSid)
+		if save == nil {
+			return 0, fmt.Errorf("failed to find save %d", sid)
+		}
+		if err := deleteSaveVal(tx, save, blobs, sid,
+			rawFilename); err != nil {
+			return 0, err
+		}
+		if rawKey, _ := save.Cursor().First(); rawKey == nil {
+			if err := saves.DeleteBucket(rawSid); err != nil {
+				return 0, err
+			}
+			if err := saveInfo.Delete(rawSid); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(sids), nil
+}
+
+// Returns the content of the given file from the specified save or an error
+// if the content isn't text.
+func (me *Fhd) textForSid(sid SID, filename string) ([]byte, error) {
+	var raw bytes.Buffer
+	if err := me.ExtractForSid(sid, filename, &raw); err != nil {
+		return nil, err
+	}
+	if kind := fileKindForRaw(raw.Bytes()); kind != txtKind {
+		return nil, fmt.Errorf("can't diff %s: its content in save %d "+
+			"isn't text (%s)", filename, sid, kind)
+	}
+	return raw.Bytes(), nil
+}
+
+// Returns the saveVal for the given file in the given save or an error if
+// there is no such save or the file isn't in it.
+func (me *Fhd) findSaveVal(tx *bolt.Tx, sid SID, filename string) (*saveVal,
+	error) {
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return nil, fmt.Errorf("failed to find %q", savesBucket)
+	}
+	save := saves.Bucket(sid.marshal())
+	if save == nil {
+		return nil, fmt.Errorf("failed to find save %d", sid)
+	}
+	rawSaveVal := save.Get([]byte(filename))
+	if rawSaveVal == nil {
+		return nil, fmt.Errorf("failed to find file %s in save %d", filename,
+			sid)
+	}
+	return unmarshalSaveVal(rawSaveVal), nil
+}
+
+// Returns nil if the given file is in the given save.
+func (me *Fhd) checkSaved(sid SID, filename string) error {
+	return me.view(func(tx *bolt.Tx) error {
+		_, err := me.findSaveVal(tx, sid, filename)
+		return err
+	})
+}
+
+// Returns the given file's StateItem and true if the file exists and its
+// content differs from its most recently saved content (or it has never
+// been saved).
+func (me *Fhd) changedSinceSave(filename string) (*StateItem, bool,
+	error) {
+	stateItem := newState(filename, newStateVal(InvalidSID, false,
+		binKind))
+	if !gong.FileExists(me.diskPath(filename)) {
+		return stateItem, false, nil
+	}
+	sha, _, err := fileShaAndKind(me.diskPath(filename))
+	if err != nil {
+		return stateItem, false, err
+	}
+	changed := true
+	err = me.view(func(tx *bolt.Tx) error {
+		states := tx.Bucket(statesBucket)
+		if states == nil {
+			return fmt.Errorf("failed to find %q", statesBucket)
+		}
+		saves := tx.Bucket(savesBucket)
+		if saves == nil {
+			return fmt.Errorf("failed to find %q", savesBucket)
+		}
+		if rawStateVal := states.Get([]byte(filename)); rawStateVal != nil {
+			stateItem.StateVal = unmarshalStateVal(rawStateVal)
+			changed = !me.sameAsPrev(saves, InvalidSID, filename,
+				stateItem.LastSid, &sha)
+		}
+		return nil
+	})
+	return stateItem, changed, err
+}
+
+func (me *Fhd) status(saves *bolt.Bucket, stateItem *StateItem) (
+	*StatusItem, error) {
+	diskPath := me.diskPath(stateItem.Filename)
+	if !gong.FileExists(diskPath) {
+		return newStatusItem(stateItem.Filename, StatusMissing,
+			stateItem.LastSid), nil
+	}
+	sha, kind, err := fileShaAndKind(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	fileStatus := StatusModified
+	if me.sameAsPrev(saves, InvalidSID, stateItem.Filename,
+		stateItem.LastSid, &sha) {
+		fileStatus = StatusUnchanged
+	} else if stateItem.LastSid.IsValid() && kind != stateItem.FileKind {
+		fileStatus = StatusKindChanged
+	}
+	return newStatusItem(stateItem.Filename, fileStatus,
+		stateItem.LastSid), nil
+}
+
+// Writes the given file's content from the given save to the target
+// filename by writing to a temporary file and renaming it over the target.
+// If the target exists its permissions are preserved.
+func (me *Fhd) restoreTo(ctx context.Context, sid SID, filename,
+	target string) error {
+	mode := fs.FileMode(gong.ModeUserRW)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	temp := file.Name()
+	err = me.ExtractForSidContext(ctx, sid, filename, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	if err == nil {
+		err = os.Chmod(temp, mode)
+	}
+	if err == nil {
+		err = os.Rename(temp, target)
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+	}
+	return err
+}
+
+// Returns the SID of the most recent save at or before the given SID for
+// every monitored file that has such a save.
+func (me *Fhd) snapshotSids(tx *bolt.Tx, sid SID) (map[string]SID, error) {
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return nil, fmt.Errorf("failed to find %q", savesBucket)
+	}
+	states := tx.Bucket(statesBucket)
+	if states == nil {
+		return nil, fmt.Errorf("failed to find %q", statesBucket)
+	}
+	rawSid := sid.marshal()
+	if saves.Bucket(rawSid) == nil {
+		return nil, fmt.Errorf("failed to find save %d", sid)
+	}
+	unresolved := gset.New[string]()
+	cursor := states.Cursor()
+	rawFilename, rawStateVal := cursor.First()
+	for ; rawFilename != nil; rawFilename, rawStateVal = cursor.Next() {
+		if unmarshalStateVal(rawStateVal).Monitored {
+			unresolved.Add(string(rawFilename))
+		}
+	}
+	sids := make(map[string]SID, len(unresolved))
+	cursor = saves.Cursor()
+	rawSid, _ = cursor.Seek(rawSid)
+	for ; rawSid != nil && len(unresolved) > 0; rawSid, _ = cursor.Prev() {
+		save := saves.Bucket(rawSid)
+		if save == nil {
+			continue
+		}
+		for filename := range unresolved {
+			if save.Get([]byte(filename)) != nil {
+				sids[filename] = unmarshalSid(rawSid)
+				unresolved.Delete(filename)
+			}
+		}
+	}
+	return sids, nil
+}
+
+// Returns the target filename for each of the given files in destDir or an
+// error if any are outside destDir, or exist and overwrite is false.
+func snapshotTargets(sids map[string]SID, destDir string,
+	overwrite bool) (map[string]string, error) {
+	targets := make(map[string]string, len(sids))
+	var err error
+	for filename := range sids {
+		if !filepath.IsLocal(filename) {
+			err = errors.Join(err, fmt.Errorf(
+				"can't restore %s outside %s", filename, destDir))
+			continue
+		}
+		target := filepath.Join(destDir, filename)
+		if !overwrite && gong.PathExists(target) {
+			err = errors.Join(err, fmt.Errorf(
+				"won't overwrite existing %s", target))
+			continue
+		}
+		targets[filename] = target
+	}
+	return targets, err
+}
+
+// Returns the given filename (which if relative is relative to the .fhd
+// file's folder) as an absolute path, so that files are found whatever the
+// current directory (e.g., a Broker's) is.
+func (me *Fhd) diskPath(filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(filepath.Dir(me.filename), filename)
+}
+
 func (me *Fhd) relativePath(filename string) string {
-	relPath, err := filepath.Rel(filepath.Dir(me.db.Path()), filename)
+	relPath, err := filepath.Rel(filepath.Dir(me.filename), filename)
 	if err != nil {
 		return filepath.Clean(filename)
 	}
 	return relPath
 }
+
+// me.dbLock must be held for writing.
+func (me *Fhd) compactTo(ctx context.Context, temp string) error {
+	_ = os.Remove(temp) // in case an earlier compaction was interrupted
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := bolt.Open(temp, gong.ModeUserRW, nil)
+	if err != nil {
+		return err
+	}
+	if err = bolt.Compact(db, me.db, compactTxMaxSize); err == nil {
+		if err = ctx.Err(); err == nil {
+			err = checkCompacted(db, me.db)
+		}
+	}
+	if err == nil {
+		err = ctx.Err() // last chance before the rename
+	}
+	if closeErr := db.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
+
+// Returns nil if the compacted database passes bolt's consistency check
+// and has the same buckets with the same numbers of keys as the original.
+func checkCompacted(compacted, original *bolt.DB) error {
+	return compacted.View(func(compactedTx *bolt.Tx) error {
+		var err error
+		for ierr := range compactedTx.Check() {
+			err = errors.Join(err, ierr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to verify compacted data: %w", err)
+		}
+		return original.View(func(originalTx *bolt.Tx) error {
+			return checkCompactedBuckets(compactedTx, originalTx)
+		})
+	})
+}
+
+func checkCompactedBuckets(compactedTx, originalTx *bolt.Tx) error {
+	return originalTx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		compactedBucket := compactedTx.Bucket(name)
+		if compactedBucket == nil {
+			return fmt.Errorf("failed to find %q in compacted data", name)
+		}
+		expected := bucket.Stats().KeyN
+		actual := compactedBucket.Stats().KeyN
+		if actual != expected {
+			return fmt.Errorf("compacted %q has %d keys, expected %d", name,
+				actual, expected)
+		}
+		return nil
+	})
+}
+
+// me.dbLock must be held for writing.
+func (me *Fhd) reopen(filename string) error {
+	db, err := newDb(filename, me.options)
+	if err != nil {
+		return err
+	}
+	me.db = db
+	return nil
+}
+
+// Returns the first filename that refers to each blob (for choosing its
+// codecs), the SHA256 of the last blob done if a previous Recompress was
+// interrupted, and the number of blobs already done and in total.
+func recompressStart(tx *bolt.Tx) (map[shA256]string, []byte, int, int,
+	error) {
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return nil, nil, 0, 0, fmt.Errorf("failed to find %q",
+			savesBucket)
+	}
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return nil, nil, 0, 0, fmt.Errorf("failed to find %q",
+			configBucket)
+	}
+	filenames := make(map[shA256]string)
+	err = saves.ForEach(func(rawSid, _ []byte) error {
+		save := saves.Bucket(rawSid)
+		if save == nil {
+			return nil
+		}
+		return save.ForEach(func(rawFilename, rawSaveVal []byte) error {
+			sha := unmarshalSaveVal(rawSaveVal).Sha
+			if _, ok := filenames[sha]; !ok {
+				filenames[sha] = string(rawFilename)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	resumeSha := bytes.Clone(config.Get(configRecompress))
+	done, total := 0, 0
+	_ = blobs.ForEach(func(rawSha, _ []byte) error {
+		total++
+		if resumeSha != nil && bytes.Compare(rawSha, resumeSha) <= 0 {
+			done++
+		}
+		return nil
+	})
+	return filenames, resumeSha, done, total, nil
+}
+
+// Recompresses the blobs after resumeSha (or from the first if nil) until
+// about maxTxSize bytes have been done. Returns the SHA256 of the last blob
+// done and whether there are more to do; this is also recorded in the
+// config so that an interrupted Recompress can be resumed.
+func (me *Fhd) recompressBatch(ctx context.Context, tx *bolt.Tx,
+	resumeSha []byte,
+	filenames map[shA256]string, ids []byte, maxTxSize int,
+	result *RecompressResult) ([]byte, bool, error) {
+	blobs, err := getBlobs(tx)
+	if err != nil {
+		return nil, false, err
+	}
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return nil, false, fmt.Errorf("failed to find %q", configBucket)
+	}
+	codecs := getCodecs(tx)
+	shas := make([]shA256, 0)
+	size := 0
+	cursor := blobs.Cursor()
+	rawSha, rawBlobVal := cursor.First()
+	if resumeSha != nil {
+		rawSha, rawBlobVal = cursor.Seek(resumeSha)
+		if rawSha != nil && bytes.Equal(rawSha, resumeSha) {
+			rawSha, rawBlobVal = cursor.Next()
+		}
+	}
+	for ; rawSha != nil && size < maxTxSize; rawSha,
+		rawBlobVal = cursor.Next() {
+		shas = append(shas, shA256(rawSha))
+		size += len(rawBlobVal)
+	}
+	more := rawSha != nil
+	for _, sha := range shas {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err // roll back
+		}
+		blobIds := ids
+		if len(blobIds) == 0 {
+			blobIds = codecIdsForFilename(codecs, filenames[sha])
+		}
+		oldSize, newSize, err := recompressBlob(blobs, sha, blobIds)
+		if err != nil {
+			return nil, false, err
+		}
+		result.Blobs++
+		if newSize < oldSize {
+			result.Recompressed++
+		}
+		result.OldSize += int64(oldSize)
+		result.NewSize += int64(newSize)
+	}
+	if !more {
+		return nil, false, config.Delete(configRecompress)
+	}
+	lastSha := shas[len(shas)-1]
+	return lastSha[:], true, config.Put(configRecompress, lastSha[:])
+}
+
+// Rewrites the given blob if the best of the given codecs makes it smaller
+// (for deltas only the delta itself is recompressed). Returns the blob's
+// old and new sizes.
+func recompressBlob(blobs *bolt.Bucket, sha shA256, ids []byte) (int, int,
+	error) {
+	oldBlobVal := getBlobVal(blobs, sha)
+	if oldBlobVal == nil {
+		return 0, 0, fmt.Errorf("failed to find blob %x", sha)
+	}
+	oldSize := len(oldBlobVal.Blob)
+	if oldBlobVal.Compression == chunkedCompression {
+		return oldSize, oldSize, nil // too big to hold in memory
+	}
+	raw, err := blobContent(blobs, sha)
+	if err != nil {
+		return oldSize, oldSize, err
+	}
+	if shA256(sha256.Sum256(raw)) != sha {
+		return oldSize, oldSize, fmt.Errorf("blob %x has the wrong SHA256",
+			sha)
+	}
+	var newBlobVal blobVal
+	if oldBlobVal.Compression.isDelta() {
+		deltaVal, err := unmarshalDeltaVal(oldBlobVal.Blob)
+		if err != nil {
+			return oldSize, oldSize, err
+		}
+		var delta bytes.Buffer
+		if err = decompress(&delta, deltaVal.Compression,
+			deltaVal.Delta); err != nil {
+			return oldSize, oldSize, err
+		}
+		deltaVal.Compression, deltaVal.Delta = compressWith(delta.Bytes(),
+			ids)
+		newBlobVal = blobVal{Refs: oldBlobVal.Refs,
+			Compression: oldBlobVal.Compression, Blob: deltaVal.marshal()}
+		// Rebuilding checks the new delta against the blob's SHA256
+		if _, err = deltaContent(blobs, sha, &newBlobVal, 1); err != nil {
+			return oldSize, oldSize, err
+		}
+	} else {
+		newBlobVal = blobVal{Refs: oldBlobVal.Refs}
+		newBlobVal.Compression, newBlobVal.Blob = compressWith(raw, ids)
+		var check bytes.Buffer
+		if err = decompress(&check, newBlobVal.Compression,
+			newBlobVal.Blob); err != nil {
+			return oldSize, oldSize, err
+		}
+		if shA256(sha256.Sum256(check.Bytes())) != sha {
+			return oldSize, oldSize, fmt.Errorf(
+				"recompressed blob %x has the wrong SHA256", sha)
+		}
+	}
+	if len(newBlobVal.Blob) >= oldSize {
+		return oldSize, oldSize, nil
+	}
+	return oldSize, len(newBlobVal.Blob), putBlob(blobs, sha, &newBlobVal)
+}
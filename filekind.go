@@ -14,6 +14,9 @@ const (
 	txtKind fileKind = 'T'
 )
 
+// The most bytes http.DetectContentType considers.
+const sniffSize = 512
+
 type fileKind byte
 
 func (me fileKind) String() string {
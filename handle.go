@@ -0,0 +1,105 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"context"
+	"io"
+
+	"github.com/mark-summerfield/gset"
+)
+
+// Handle is the method set shared by *Fhd (which uses a .fhd file
+// directly) and *Client (which uses a .fhd file via a Broker), so that
+// callers can use either.
+type Handle interface {
+	ReadOnly() bool
+	Close() error
+	String() string
+	Filename() string
+	FileFormat() (int, error)
+	States() ([]*StateItem, error)
+	Monitored() ([]*StateItem, error)
+	Monitor(filenames ...string) (SaveResult, error)
+	MonitorWithComment(comment string, filenames ...string) (SaveResult,
+		error)
+	Unmonitored() ([]*StateItem, error)
+	Unmonitor(filenames ...string) error
+	Ignored() ([]IgnoreItem, error)
+	Ignore(ignoreItems ...IgnoreItem) error
+	Unignore(patterns ...string) error
+	Unaccounted() (gset.Set[string], error)
+	Status() ([]*StatusItem, error)
+	Save(comment string) (SaveResult, error)
+	KeepEmptySaves() bool
+	SetKeepEmptySaves(keep bool) error
+	Paranoid() bool
+	SetParanoid(paranoid bool) error
+	MaxWorkers() int
+	SetMaxWorkers(workers int)
+	ChunkThreshold() int64
+	SetChunkThreshold(threshold int64) error
+	Codecs() (map[string][]byte, error)
+	SetCodecs(pattern string, ids ...byte) error
+	SaveInfoItemForSid(sid SID) SaveInfoItem
+	SaveCount() int
+	SaveCountForSid(sid SID) int
+	Sid() SID
+	Sids() ([]SID, error)
+	StateForFilename(filename string) (StateVal, error)
+	SidsForFilename(filename string) ([]SID, error)
+	ExtractFile(filename string) (string, error)
+	ExtractFileForSid(sid SID, filename string) (string, error)
+	Extract(filename string, writer io.Writer) error
+	ExtractForSid(sid SID, filename string, writer io.Writer) error
+	Restore(sid SID, filename string) (SaveResult, error)
+	SnapshotSids(sid SID) (map[string]SID, error)
+	RestoreSnapshot(sid SID, destDir string, overwrite bool) ([]string,
+		error)
+	Diff(filename string, sidA, sidB SID) (*Diff, error)
+	DiffWorking(filename string, sid SID) (*Diff, error)
+	Rename(oldFilename, newFilename string) (SaveResult, error)
+	Compact() (int64, int64, error)
+	Recompress(options RecompressOptions) (RecompressResult, error)
+	Delete(sid SID, filename string) error
+	Purge(filename string, compact bool) error
+	Dump() error
+	DumpTo(writer io.Writer) error
+	UnaccountedContext(ctx context.Context) (gset.Set[string], error)
+	StatusContext(ctx context.Context) ([]*StatusItem, error)
+	SaveContext(ctx context.Context, comment string) (SaveResult, error)
+	MonitorContext(ctx context.Context, filenames ...string) (SaveResult,
+		error)
+	MonitorWithCommentContext(ctx context.Context, comment string,
+		filenames ...string) (SaveResult, error)
+	ExtractContext(ctx context.Context, filename string,
+		writer io.Writer) error
+	ExtractForSidContext(ctx context.Context, sid SID, filename string,
+		writer io.Writer) error
+	RestoreContext(ctx context.Context, sid SID, filename string) (SaveResult,
+		error)
+	RestoreSnapshotContext(ctx context.Context, sid SID, destDir string,
+		overwrite bool) ([]string, error)
+	CompactContext(ctx context.Context) (int64, int64, error)
+	RecompressContext(ctx context.Context,
+		options RecompressOptions) (RecompressResult, error)
+	Generation() (uint64, error)
+	Watch(ctx context.Context) (<-chan WatchEvent, error)
+}
+
+var (
+	_ Handle = (*Fhd)(nil)
+	_ Handle = (*Client)(nil)
+)
+
+// Open returns a Client if a Broker is serving the given .fhd file (in
+// which case only the options' Progress is used); otherwise it opens the
+// .fhd file directly using NewWithOptions.
+func Open(filename string, options Options) (Handle, error) {
+	if client, err := NewClient(SocketPathForFilename(filename)); err == nil {
+		client.progress = options.Progress
+		return client, nil
+	}
+	return NewWithOptions(filename, options)
+}
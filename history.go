@@ -0,0 +1,104 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The history bucket indexes which saves have each file so that a file's
+// saves can be found without scanning every save. Its keys are the
+// filename, a 0 byte, and the SID (so each file's keys are in SID order),
+// and its values are empty.
+
+func historyPrefix(rawFilename []byte) []byte {
+	return append(append(make([]byte, 0, len(rawFilename)+1+sidSize),
+		rawFilename...), 0)
+}
+
+func historyKey(rawFilename []byte, sid SID) []byte {
+	return append(historyPrefix(rawFilename), sid.marshal()...)
+}
+
+func getHistory(tx *bolt.Tx) (*bolt.Bucket, error) {
+	history := tx.Bucket(historyBucket)
+	if history == nil {
+		return nil, fmt.Errorf("failed to find %q", historyBucket)
+	}
+	return history, nil
+}
+
+func putHistory(tx *bolt.Tx, rawFilename []byte, sid SID) error {
+	history, err := getHistory(tx)
+	if err != nil {
+		return err
+	}
+	return history.Put(historyKey(rawFilename, sid), []byte{})
+}
+
+func deleteHistory(tx *bolt.Tx, rawFilename []byte, sid SID) error {
+	history, err := getHistory(tx)
+	if err != nil {
+		return err
+	}
+	return history.Delete(historyKey(rawFilename, sid))
+}
+
+// Returns the SIDs of the saves that have the given file from least- to
+// most-recent.
+func sidsForFilename(history *bolt.Bucket, rawFilename []byte) []SID {
+	sids := make([]SID, 0)
+	prefix := historyPrefix(rawFilename)
+	cursor := history.Cursor()
+	key, _ := cursor.Seek(prefix)
+	for ; key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		sids = append(sids, unmarshalSid(key[len(prefix):]))
+	}
+	return sids
+}
+
+// Returns the SID of the most recent save that has the given file or
+// InvalidSID if there isn't one.
+func lastSidForFilename(history *bolt.Bucket, rawFilename []byte) SID {
+	prefix := historyPrefix(rawFilename)
+	cursor := history.Cursor()
+	// Filenames can't contain 0 bytes so this is just after the file's keys
+	key, _ := cursor.Seek(append(bytes.Clone(rawFilename), 1))
+	if key == nil {
+		key, _ = cursor.Last()
+	} else {
+		key, _ = cursor.Prev()
+	}
+	if key != nil && bytes.HasPrefix(key, prefix) {
+		return unmarshalSid(key[len(prefix):])
+	}
+	return InvalidSID
+}
+
+// Creates the history bucket from the saves: for files made before the
+// history bucket existed.
+func makeHistory(tx *bolt.Tx) error {
+	history, err := tx.CreateBucket(historyBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %s", historyBucket,
+			err)
+	}
+	saves := tx.Bucket(savesBucket)
+	if saves == nil {
+		return fmt.Errorf("failed to find %q", savesBucket)
+	}
+	return saves.ForEach(func(rawSid, _ []byte) error {
+		save := saves.Bucket(rawSid)
+		if save == nil {
+			return nil
+		}
+		sid := unmarshalSid(rawSid)
+		return save.ForEach(func(rawFilename, _ []byte) error {
+			return history.Put(historyKey(rawFilename, sid), []byte{})
+		})
+	})
+}
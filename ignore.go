@@ -0,0 +1,111 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	IgnoreFilename IgnoreKind = 'f' // a filename or relative path
+	IgnoreDirname  IgnoreKind = 'd' // a directory name or glob
+	IgnoreGlob     IgnoreKind = 'g' // a glob matched against filenames
+)
+
+type IgnoreKind byte
+
+func (me IgnoreKind) String() string {
+	return string(me)
+}
+
+func (me IgnoreKind) IsValid() bool {
+	return me == IgnoreFilename || me == IgnoreDirname || me == IgnoreGlob
+}
+
+type IgnoreItem struct {
+	Pattern    string
+	IgnoreKind IgnoreKind
+}
+
+// NewIgnoreItem returns an IgnoreItem for the given pattern with its kind
+// deduced from the pattern: a pattern ending with a path separator is a
+// dirname (and the separator is dropped), a pattern containing any of
+// "*?[" is a glob, and anything else is a filename.
+func NewIgnoreItem(pattern string) IgnoreItem {
+	if trimmed := strings.TrimRight(pattern, `/\`); trimmed != "" &&
+		trimmed != pattern {
+		return IgnoreItem{Pattern: trimmed, IgnoreKind: IgnoreDirname}
+	}
+	return IgnoreItem{Pattern: pattern, IgnoreKind: ignoreKindForPattern(
+		pattern)}
+}
+
+func newIgnoreItemFromRaw(rawPattern, rawIgnoreKind []byte) IgnoreItem {
+	ignoreKind := ignoreKindForPattern(string(rawPattern))
+	if len(rawIgnoreKind) == 1 {
+		ignoreKind = IgnoreKind(rawIgnoreKind[0])
+	}
+	return IgnoreItem{Pattern: string(rawPattern), IgnoreKind: ignoreKind}
+}
+
+func ignoreKindForPattern(pattern string) IgnoreKind {
+	if strings.ContainsAny(pattern, "*?[") {
+		return IgnoreGlob
+	}
+	return IgnoreFilename
+}
+
+func (me IgnoreItem) String() string {
+	return fmt.Sprintf("%q%s", me.Pattern, me.IgnoreKind)
+}
+
+// Returns true if the given relative path should be ignored.
+// A filename matches the path's basename or the whole path; a dirname
+// matches any of the path's directory components (or a leading part of the
+// path if it contains a separator); and a glob matches the path's basename
+// (or the whole path if it contains a separator).
+func (me IgnoreItem) matches(filename string) bool {
+	hasSep := strings.ContainsRune(me.Pattern, filepath.Separator)
+	switch me.IgnoreKind {
+	case IgnoreFilename:
+		return me.Pattern == filepath.Base(filename) ||
+			me.Pattern == filename
+	case IgnoreDirname:
+		return me.matchesDir(filepath.Dir(filename))
+	case IgnoreGlob:
+		name := filename
+		if !hasSep {
+			name = filepath.Base(filename)
+		}
+		if matched, err := filepath.Match(me.Pattern, name); matched &&
+			err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if this is a dirname ignore that matches the given relative
+// directory path.
+func (me IgnoreItem) matchesDir(dirname string) bool {
+	if me.IgnoreKind != IgnoreDirname {
+		return false
+	}
+	if strings.ContainsRune(me.Pattern, filepath.Separator) {
+		return dirname == me.Pattern || strings.HasPrefix(dirname,
+			me.Pattern+string(filepath.Separator))
+	}
+	for _, name := range strings.Split(dirname, string(filepath.Separator)) {
+		if name == "." || name == ".." {
+			continue
+		}
+		if matched, err := filepath.Match(me.Pattern, name); matched &&
+			err == nil {
+			return true
+		}
+	}
+	return false
+}
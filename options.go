@@ -0,0 +1,36 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import "time"
+
+// Options are used when opening a .fhd file with NewWithOptions.
+type Options struct {
+	// If true the .fhd file is opened with a shared lock so that any
+	// number of read-only handles (e.g., command line queries) can use it
+	// at once. The file must already exist, and every method that would
+	// change it returns ErrReadOnly.
+	ReadOnly bool
+	// How long to wait for the .fhd file's lock (e.g., if another process
+	// has it open read-write) before returning ErrBusy; 0 means wait for
+	// ever.
+	Timeout time.Duration
+	// If not nil, called with the progress of each Save (including those
+	// done by Monitor and Restore), RestoreSnapshot, and Recompress. (For
+	// a single call, use WithProgress instead.)
+	Progress func(ProgressEvent)
+}
+
+// BrokerOptions are used when starting a Broker with NewBroker.
+type BrokerOptions struct {
+	// The Unix domain socket to serve on; "" means the one returned by
+	// SocketPathForFilename.
+	SocketPath string
+	// How long to wait after the last client disconnects before shutting
+	// down; 0 means the default (5 minutes).
+	IdleTimeout time.Duration
+	// How long to wait for the .fhd file's lock before returning ErrBusy; 0
+	// means wait for ever.
+	Timeout time.Duration
+}
@@ -0,0 +1,344 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/mark-summerfield/gong"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A monitored file prepared for saving. The reading, hashing, and
+// compressing are done by a pool of workers outside the write transaction
+// so that the transaction only has to do the Puts.
+type preparedFile struct {
+	*StateItem
+	exists    bool
+	info      fs.FileInfo
+	unchanged bool   // Its stat data or SHA256 matches its LastSid's
+	statHit   bool   // Unchanged according to its stat data
+	diskPath  string // Set if its content can be reread whole
+	sha       shA256
+	kind      fileKind
+	blobVal   *blobVal // nil if unchanged or if the blob is already stored
+	chunked   bool     // Chunks may have been stored under its SHA256
+	err       error
+	progress  *progressReporter
+	// Set when its content is put so that ProgressStored can be reported
+	// once the save is committed
+	stored      bool
+	storedCodec byte
+	storedSize  int64
+}
+
+// Makes a save's workers store the chunks of any given content one at a
+// time, so that identical large files don't store the same chunks at the
+// same time: the first to succeed stores them and the rest reuse its
+// blobVal.
+type chunkLocks struct {
+	mutex    sync.Mutex
+	locks    map[shA256]*sync.Mutex
+	blobVals map[shA256]*blobVal
+}
+
+func newChunkLocks() *chunkLocks {
+	return &chunkLocks{locks: make(map[shA256]*sync.Mutex),
+		blobVals: make(map[shA256]*blobVal)}
+}
+
+// Waits until no other worker is storing chunks under the given SHA256
+// and returns their blobVal if they succeeded or else nil (in which case
+// the caller should store the chunks and call stored if it succeeds), and
+// the function to call when finished.
+func (me *chunkLocks) lock(sha shA256) (*blobVal, func()) {
+	me.mutex.Lock()
+	lock, ok := me.locks[sha]
+	if !ok {
+		lock = &sync.Mutex{}
+		me.locks[sha] = lock
+	}
+	me.mutex.Unlock()
+	lock.Lock()
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.blobVals[sha], lock.Unlock
+}
+
+func (me *chunkLocks) stored(sha shA256, blobVal *blobVal) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.blobVals[sha] = blobVal
+}
+
+// Returns the number of workers to prepare files with: me.saving must be
+// locked.
+func (me *Fhd) workers() int {
+	if me.maxWorkers > 0 {
+		return me.maxWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// Returns the given files prepared for saving in the same order using up
+// to workers() goroutines.
+func (me *Fhd) prepareFiles(ctx context.Context, stateItems []*StateItem,
+	progress *progressReporter) []*preparedFile {
+	prepared := make([]*preparedFile, len(stateItems))
+	workers := me.workers()
+	if workers > len(stateItems) {
+		workers = len(stateItems)
+	}
+	locks := newChunkLocks()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				prepared[j] = me.prepareFile(ctx, stateItems[j],
+					progress, locks)
+			}
+		}()
+	}
+	for j := range stateItems {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	return prepared
+}
+
+// Reads, hashes, and (if its content isn't already stored) compresses the
+// given file: unless paranoid, files whose stat data hasn't changed since
+// they were last saved or checked aren't even read. Files at or above the
+// chunk threshold are streamed, and their chunks stored, a chunk at a time.
+func (me *Fhd) prepareFile(ctx context.Context, stateItem *StateItem,
+	progress *progressReporter, locks *chunkLocks) *preparedFile {
+	file := &preparedFile{StateItem: stateItem, progress: progress}
+	if file.err = ctx.Err(); file.err != nil {
+		return file
+	}
+	diskPath := me.diskPath(stateItem.Filename)
+	if !gong.FileExists(diskPath) {
+		progress.start(stateItem.Filename, 0)
+		return file
+	}
+	file.exists = true
+	file.info, file.err = os.Stat(diskPath)
+	if file.err != nil {
+		progress.start(stateItem.Filename, 0)
+		return file
+	}
+	progress.start(stateItem.Filename, file.info.Size())
+	var (
+		prevSha *shA256
+		ids     []byte
+		chunked bool
+	)
+	file.err = me.view(func(tx *bolt.Tx) error {
+		stats := tx.Bucket(statsBucket)
+		if stats == nil {
+			return fmt.Errorf("failed to find %q", statsBucket)
+		}
+		saves := tx.Bucket(savesBucket)
+		if saves == nil {
+			return fmt.Errorf("failed to find %q", savesBucket)
+		}
+		if stateItem.LastSid != InvalidSID {
+			if !getConfigFlag(tx, configParanoid) && sameStat(stats,
+				stateItem.Filename, newStatVal(stateItem.LastSid,
+					file.info)) {
+				file.unchanged = true
+				file.statHit = true
+				return nil
+			}
+			if saveVal := me.getSaveVal(saves, stateItem.Filename,
+				stateItem.LastSid); saveVal != nil {
+				prevSha = &saveVal.Sha
+			}
+		}
+		ids = bytes.Clone(codecIdsForFilename(getCodecs(tx),
+			stateItem.Filename))
+		chunked = file.info.Size() >= getChunkThreshold(tx)
+		return nil
+	})
+	if file.err != nil {
+		return file
+	}
+	if !file.statHit {
+		if chunked {
+			file.err = me.prepareChunkedFile(ctx, file, prevSha, ids,
+				locks)
+		} else {
+			file.err = me.prepareWholeFile(file, prevSha, ids)
+		}
+	}
+	if file.unchanged {
+		progress.report(ProgressUnchanged, file.Filename, 0,
+			file.info.Size())
+	}
+	return file
+}
+
+func (me *Fhd) prepareWholeFile(file *preparedFile, prevSha *shA256,
+	ids []byte) error {
+	diskPath := me.diskPath(file.Filename)
+	raw, sha, err := getRaw(diskPath)
+	if err != nil {
+		return err
+	}
+	file.sha = sha
+	file.progress.report(ProgressHashed, file.Filename, 0, int64(len(raw)))
+	file.kind = fileKindForRaw(raw)
+	if prevSha != nil && *prevSha == file.sha {
+		file.unchanged = true
+		return nil
+	}
+	// Only the blobVal is kept until the save is committed: the raw
+	// content is reread in the rare case that it's needed again.
+	file.diskPath = diskPath
+	return me.view(func(tx *bolt.Tx) error {
+		blobs, err := getBlobs(tx)
+		if err != nil {
+			return err
+		}
+		if getBlobVal(blobs, file.sha) != nil {
+			return nil // Only compress content that isn't already stored.
+		}
+		file.blobVal, err = maybeDeltaBlobVal(blobs, prevSha, raw,
+			newBlobVal(compressWith(raw, ids)))
+		return err
+	})
+}
+
+// Large files are hashed, and if new, stored in chunks, by streaming them.
+func (me *Fhd) prepareChunkedFile(ctx context.Context, file *preparedFile,
+	prevSha *shA256, ids []byte, locks *chunkLocks) error {
+	var err error
+	file.sha, file.kind, err = fileShaAndKind(me.diskPath(file.Filename))
+	if err != nil {
+		return err
+	}
+	file.progress.report(ProgressHashed, file.Filename, 0, file.info.Size())
+	if prevSha != nil && *prevSha == file.sha {
+		file.unchanged = true
+		return nil
+	}
+	var found bool
+	if err = me.view(func(tx *bolt.Tx) error {
+		blobs, err := getBlobs(tx)
+		if err == nil {
+			found = getBlobVal(blobs, file.sha) != nil
+		}
+		return err
+	}); err != nil || found {
+		return err
+	}
+	blobVal, unlock := locks.lock(file.sha)
+	defer unlock()
+	if blobVal != nil {
+		file.blobVal = blobVal
+		return nil
+	}
+	file.chunked = true
+	if file.blobVal, err = me.putChunks(ctx, file.Filename, file.sha,
+		ids); err == nil {
+		locks.stored(file.sha, file.blobVal)
+	}
+	return err
+}
+
+// Returns a delta blobVal against the file's previous version if it is
+// smaller enough than the given blobVal; otherwise returns the given
+// blobVal.
+func maybeDeltaBlobVal(blobs *bolt.Bucket, prevSha *shA256, raw []byte,
+	blobVal *blobVal) (*blobVal, error) {
+	if prevSha == nil {
+		return blobVal, nil
+	}
+	deltaBlobVal, err := deltaBlobVal(blobs, *prevSha, raw,
+		fileKindForRaw(raw), len(blobVal.Blob))
+	if err != nil || deltaBlobVal == nil {
+		return blobVal, err
+	}
+	return deltaBlobVal, nil
+}
+
+// Stores the given file's prepared blob or adds a reference to it if it is
+// already stored (in which case it returns true); a new delta blob's base
+// gets a reference too. If the blob's base (or the blob itself) has been
+// deleted since the file was prepared, the file is reread and compressed
+// afresh.
+func (me *preparedFile) storeBlob(tx *bolt.Tx, blobs *bolt.Bucket) (bool,
+	error) {
+	found, err := addBlobRef(blobs, me.sha)
+	if err != nil || found {
+		return found, err
+	}
+	blobVal := me.blobVal
+	if blobVal != nil && blobVal.Compression.isDelta() {
+		deltaVal, err := unmarshalDeltaVal(blobVal.Blob)
+		if err != nil {
+			return false, err
+		}
+		if found, err = addBlobRef(blobs, deltaVal.BaseSha); err != nil {
+			return false, err
+		}
+		if !found {
+			blobVal = nil
+		}
+	}
+	if blobVal == nil {
+		if me.diskPath == "" {
+			return false, fmt.Errorf("%s's content was deleted while it "+
+				"was being saved", me.Filename)
+		}
+		raw, sha, err := getRaw(me.diskPath)
+		if err != nil {
+			return false, err
+		}
+		if sha != me.sha {
+			return false, fmt.Errorf("%s changed while being saved",
+				me.Filename)
+		}
+		blobVal = newBlobVal(compressWith(raw,
+			codecIdsForFilename(getCodecs(tx), me.Filename)))
+	}
+	return false, putBlob(blobs, me.sha, blobVal)
+}
+
+// Notes how the given file's content is stored for reportStored: found is
+// true if it was already stored before this save.
+func (me *preparedFile) noteStored(blobs *bolt.Bucket, found bool) {
+	me.stored = true
+	if me.progress == nil {
+		return
+	}
+	if blobVal := getBlobVal(blobs, me.sha); blobVal != nil {
+		me.storedCodec = byte(blobVal.Compression)
+		if !found {
+			me.storedSize = int64(len(blobVal.Blob))
+			if blobVal.Compression == chunkedCompression {
+				me.storedSize = chunksSize(blobs.Tx(), me.sha)
+			}
+		}
+	}
+}
+
+// Reports how the given file's content is stored: only called once the
+// save is committed so that a rolled back save reports nothing stored.
+func (me *preparedFile) reportStored() {
+	if me.stored {
+		me.progress.report(ProgressStored, me.Filename, me.storedCodec,
+			me.storedSize)
+	}
+}
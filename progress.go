@@ -0,0 +1,150 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	ProgressStarted      ProgressKind = 'S' // A file is about to be read
+	ProgressHashed       ProgressKind = 'H' // A file has been hashed
+	ProgressUnchanged    ProgressKind = 'U' // A file hasn't changed
+	ProgressStored       ProgressKind = 'W' // A file's content was saved
+	ProgressMissing      ProgressKind = 'M' // A file is missing
+	ProgressIgnored      ProgressKind = 'I' // A file is ignored
+	ProgressFailed       ProgressKind = 'X' // A file couldn't be saved
+	ProgressRestored     ProgressKind = 'R' // A file has been restored
+	ProgressRecompressed ProgressKind = 'Z' // A batch of blobs is done
+)
+
+type ProgressKind byte
+
+func (me ProgressKind) String() string {
+	return string(me)
+}
+
+// Returns true if the file (or batch) is finished with.
+func (me ProgressKind) isDone() bool {
+	return me != ProgressStarted && me != ProgressHashed
+}
+
+// ProgressEvent reports progress on a single file (or for Recompress, on
+// a batch of blobs) along with the running totals. For ProgressStarted,
+// ProgressHashed, and ProgressUnchanged, Size is the file's size; for
+// ProgressStored, Codec is the Id of the codec (or delta or chunked
+// compression) the content is stored with and Size is the number of bytes
+// newly stored (0 if the content was already stored); for
+// ProgressRecompressed, Size is the number of bytes the blobs done so far
+// now occupy.
+type ProgressEvent struct {
+	Kind       ProgressKind
+	Filename   string
+	Codec      byte
+	Size       int64
+	Files      int   // The number of files finished with so far
+	TotalFiles int   // The number of files to do
+	Bytes      int64 // The number of bytes of files finished with so far
+	TotalBytes int64 // The number of bytes of files to do (if known)
+}
+
+func (me ProgressEvent) String() string {
+	codec := ""
+	if me.Codec != 0 {
+		codec = fmt.Sprintf(" %c", me.Codec)
+	}
+	return fmt.Sprintf("%s %q%s %d bytes [%d/%d files %d/%d bytes]",
+		me.Kind, me.Filename, codec, me.Size, me.Files, me.TotalFiles,
+		me.Bytes, me.TotalBytes)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of the context that makes any of the
+// ...Context methods it is passed to report their progress to the given
+// function rather than to the Options' Progress function (if any).
+func WithProgress(ctx context.Context,
+	progress func(ProgressEvent)) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// Returns the context's progress function if it has one, or else the
+// given one.
+func progressFor(ctx context.Context,
+	progress func(ProgressEvent)) func(ProgressEvent) {
+	if ctxProgress, ok := ctx.Value(progressKey{}).(func(
+		ProgressEvent)); ok {
+		return ctxProgress
+	}
+	return progress
+}
+
+// Keeps the running totals and calls the progress function one event at a
+// time. A nil *progressReporter ignores every call, so callers needn't
+// check whether progress is wanted.
+type progressReporter struct {
+	mutex      sync.Mutex
+	progress   func(ProgressEvent)
+	sizes      map[string]int64 // Of the files started but not done
+	files      int
+	totalFiles int
+	bytes      int64
+	totalBytes int64
+}
+
+// Returns nil if neither the context nor the options want progress.
+func (me *Fhd) newProgressReporter(ctx context.Context, totalFiles int,
+	totalBytes int64) *progressReporter {
+	progress := progressFor(ctx, me.options.Progress)
+	if progress == nil {
+		return nil
+	}
+	return &progressReporter{progress: progress,
+		sizes: make(map[string]int64), totalFiles: totalFiles,
+		totalBytes: totalBytes}
+}
+
+// Reports that the given file of the given size is about to be read.
+func (me *progressReporter) start(filename string, size int64) {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	me.sizes[filename] = size
+	me.mutex.Unlock()
+	me.report(ProgressStarted, filename, 0, size)
+}
+
+func (me *progressReporter) report(kind ProgressKind, filename string,
+	codec byte, size int64) {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if kind.isDone() {
+		me.files++
+		me.bytes += me.sizes[filename]
+		delete(me.sizes, filename)
+	}
+	me.progress(ProgressEvent{Kind: kind, Filename: filename, Codec: codec,
+		Size: size, Files: me.files, TotalFiles: me.totalFiles,
+		Bytes: me.bytes, TotalBytes: me.totalBytes})
+}
+
+// Reports that the given number of files (e.g., blobs) are done.
+func (me *progressReporter) advance(kind ProgressKind, files int,
+	size int64) {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.files += files
+	me.progress(ProgressEvent{Kind: kind, Size: size, Files: me.files,
+		TotalFiles: me.totalFiles, Bytes: me.bytes,
+		TotalBytes: me.totalBytes})
+}
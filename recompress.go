@@ -0,0 +1,48 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"fmt"
+
+	"github.com/mark-summerfield/gong"
+)
+
+type RecompressOptions struct {
+	// If empty each blob is compressed with the codecs chosen for its
+	// filename (see Fhd.Codecs); otherwise with the best of these.
+	CodecIds []byte
+	// The maximum number of bytes of blobs recompressed per transaction; 0
+	// means the default (64MB).
+	MaxTxSize int
+	// If not nil, called after each transaction with the number of blobs
+	// done so far (including any done before a resume) and the total.
+	// (Not called when using a Client.)
+	Progress func(done, total int) `json:"-"`
+}
+
+type RecompressResult struct {
+	Blobs        int   // The number of blobs checked
+	Recompressed int   // The number of blobs that were rewritten
+	OldSize      int64 // The bytes the checked blobs used to occupy
+	NewSize      int64 // The bytes the checked blobs now occupy
+}
+
+func (me *RecompressResult) add(other RecompressResult) {
+	me.Blobs += other.Blobs
+	me.Recompressed += other.Recompressed
+	me.OldSize += other.OldSize
+	me.NewSize += other.NewSize
+}
+
+// Saved returns the number of bytes saved by recompressing.
+func (me RecompressResult) Saved() int64 {
+	return me.OldSize - me.NewSize
+}
+
+func (me RecompressResult) String() string {
+	return fmt.Sprintf("recompressed %s/%s blobs saving %s bytes",
+		gong.Commas(me.Recompressed), gong.Commas(me.Blobs),
+		gong.Commas(int(me.Saved())))
+}
@@ -26,6 +26,7 @@ type SaveResult struct {
 	SaveInfoItem
 	MissingFiles gset.Set[string]
 	IgnoredFiles gset.Set[string]
+	NoChanges    bool // If true nothing was saved and the SID is invalid
 }
 
 func newSaveResult(sid SID, when time.Time, comment string) SaveResult {
@@ -0,0 +1,64 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"time"
+)
+
+const (
+	statSize = sidSize + 8 + 8 + 8 + 4 // *must* match statVal's size
+
+	// Files modified this recently aren't given a stats value, so they're
+	// always hashed: otherwise a change made within the file system's
+	// timestamp granularity of the save might be missed.
+	racyInterval = 2 * time.Second
+)
+
+// A stats bucket's value, keyed by filename: the file's stat data when its
+// content was last found to match the content saved in Sid.
+type statVal struct {
+	Sid   SID
+	Size  int64
+	Mtime int64 // UnixNano
+	Inode uint64
+	Mode  uint32
+}
+
+func newStatVal(sid SID, info fs.FileInfo) statVal {
+	return statVal{Sid: sid, Size: info.Size(),
+		Mtime: info.ModTime().UnixNano(), Inode: inodeForFileInfo(info),
+		Mode: uint32(info.Mode())}
+}
+
+func unmarshalStatVal(raw []byte) (statVal, bool) {
+	var statVal statVal
+	if len(raw) != statSize {
+		return statVal, false
+	}
+	statVal.Sid = unmarshalSid(raw[:sidSize])
+	raw = raw[sidSize:]
+	statVal.Size = int64(binary.BigEndian.Uint64(raw))
+	statVal.Mtime = int64(binary.BigEndian.Uint64(raw[8:]))
+	statVal.Inode = binary.BigEndian.Uint64(raw[16:])
+	statVal.Mode = binary.BigEndian.Uint32(raw[24:])
+	return statVal, true
+}
+
+func (me statVal) marshal() []byte {
+	raw := make([]byte, 0, statSize)
+	raw = append(raw, me.Sid.marshal()...)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(me.Size))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(me.Mtime))
+	raw = binary.BigEndian.AppendUint64(raw, me.Inode)
+	return binary.BigEndian.AppendUint32(raw, me.Mode)
+}
+
+// Returns true if the file was modified too recently for its stat data to
+// be trusted.
+func (me statVal) isRacy(now time.Time) bool {
+	return now.Sub(time.Unix(0, me.Mtime)) < racyInterval
+}
@@ -0,0 +1,13 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+//go:build !unix
+
+package fhd
+
+import "io/fs"
+
+// Inodes aren't available so only size, mtime, and mode are compared.
+func inodeForFileInfo(info fs.FileInfo) uint64 {
+	return 0
+}
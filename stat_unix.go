@@ -0,0 +1,18 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+//go:build unix
+
+package fhd
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func inodeForFileInfo(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
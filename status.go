@@ -0,0 +1,35 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import "fmt"
+
+const (
+	StatusUnchanged   FileStatus = '='
+	StatusModified    FileStatus = 'M'
+	StatusMissing     FileStatus = '!'
+	StatusKindChanged FileStatus = 'K'
+)
+
+type FileStatus byte
+
+func (me FileStatus) String() string {
+	return string(me)
+}
+
+type StatusItem struct {
+	Filename   string
+	FileStatus FileStatus
+	LastSid    SID // Most recent SID the corresponding file was saved into
+}
+
+func newStatusItem(filename string, fileStatus FileStatus,
+	lastSid SID) *StatusItem {
+	return &StatusItem{Filename: filename, FileStatus: fileStatus,
+		LastSid: lastSid}
+}
+
+func (me StatusItem) String() string {
+	return fmt.Sprintf("%q%s#%d", me.Filename, me.FileStatus, me.LastSid)
+}
@@ -4,71 +4,54 @@
 package fhd
 
 import (
-	"bytes"
-	"compress/flate"
-	"compress/lzw"
+	"context"
 	"crypto/sha256"
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sync"
 
 	"github.com/mark-summerfield/gong"
 )
 
-func getRaws(filename string, sha *shA256) ([]byte, []byte, []byte, error) {
+// Reads the given file and returns its content and SHA256. The content is
+// only compressed later if it turns out to be new.
+func getRaw(filename string) ([]byte, shA256, error) {
+	var sha shA256
 	raw, err := os.ReadFile(filename)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, sha, err
 	}
-	var (
-		rawFlate bytes.Buffer
-		rawLzw   bytes.Buffer
-		wg       sync.WaitGroup
-	)
-	wg.Add(3)
-	go func() { defer wg.Done(); populateSha(raw, sha) }()
-	go func() { defer wg.Done(); populateFlate(raw, &rawFlate) }()
-	go func() { defer wg.Done(); populateLzw(raw, &rawLzw) }()
-	wg.Wait()
-	return raw, rawFlate.Bytes(), rawLzw.Bytes(), nil
+	populateSha(raw, &sha)
+	return raw, sha, nil
 }
 
 func populateSha(raw []byte, sha *shA256) {
 	*sha = shA256(sha256.Sum256(raw))
 }
 
-func populateFlate(raw []byte, rawFlate *bytes.Buffer) {
-	writer, err := flate.NewWriter(rawFlate, 9)
-	if err == nil {
-		_, ierr := writer.Write(raw)
-		if ierr != nil {
-			err = errors.Join(err, ierr)
-		}
-		ierr = writer.Close()
-		if ierr != nil {
-			err = errors.Join(err, ierr)
-		}
-		if err != nil {
-			rawFlate.Reset()
-		}
+// Returns the SHA256 and kind of the given file's content without reading
+// the whole file into memory.
+func fileShaAndKind(filename string) (shA256, fileKind, error) {
+	var sha shA256
+	file, err := os.Open(filename)
+	if err != nil {
+		return sha, binKind, err
 	}
-}
-
-func populateLzw(raw []byte, rawLzw *bytes.Buffer) {
-	writer := lzw.NewWriter(rawLzw, lzw.MSB, 8)
-	_, err := writer.Write(raw)
-	if err == nil {
-		ierr := writer.Close()
-		if ierr != nil {
-			err = errors.Join(err, ierr)
-		}
-		if err != nil {
-			rawLzw.Reset()
-		}
+	defer file.Close()
+	head := make([]byte, sniffSize)
+	size, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return sha, binKind, err
+	}
+	head = head[:size]
+	hasher := sha256.New()
+	hasher.Write(head)
+	if _, err = io.Copy(hasher, file); err != nil {
+		return sha, binKind, err
 	}
+	copy(sha[:], hasher.Sum(nil))
+	return sha, fileKindForRaw(head), nil
 }
 
 func getExtractFilename(sid SID, filename string) string {
@@ -101,3 +84,42 @@ func copyFile(dest, source string) error {
 	_, err = io.Copy(dst, src)
 	return err
 }
+
+func fileSize(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// A writer that fails with the context's error once the context is done.
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (me contextWriter) Write(raw []byte) (int, error) {
+	if err := me.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return me.writer.Write(raw)
+}
+
+// A writer that keeps the first sniffSize bytes written to it and then
+// fails with errSniffed so that the rest needn't be produced.
+type sniffWriter struct {
+	head []byte
+}
+
+func (me *sniffWriter) Write(raw []byte) (int, error) {
+	size := sniffSize - len(me.head)
+	if size > len(raw) {
+		size = len(raw)
+	}
+	me.head = append(me.head, raw[:size]...)
+	if len(me.head) == sniffSize {
+		return size, errSniffed
+	}
+	return size, nil
+}
@@ -0,0 +1,199 @@
+// Copyright © 2023 Mark Summerfield. All rights reserved.
+// License: Apache-2.0
+
+package fhd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	WatchSave    WatchKind = 'S' // A new save
+	WatchMonitor WatchKind = 'M' // Files were monitored or unmonitored
+	WatchIgnore  WatchKind = 'I' // Ignores were added or removed
+	WatchOther   WatchKind = 'O' // Any other change (e.g., a Delete)
+
+	watchInterval = 500 * time.Millisecond
+)
+
+type WatchKind byte
+
+func (me WatchKind) String() string {
+	return string(me)
+}
+
+// WatchEvent reports a change to a .fhd file. A single change (e.g., a
+// Monitor) may produce more than one event (e.g., WatchMonitor and
+// WatchSave).
+type WatchEvent struct {
+	Kind       WatchKind
+	Generation uint64 // The .fhd file's generation after the change
+	Sid        SID    // The most recent save's SID after the change
+}
+
+func (me WatchEvent) String() string {
+	return fmt.Sprintf("%s@%d#%d", me.Kind, me.Generation, me.Sid)
+}
+
+// What Watch compares to find out what has changed.
+type watchSnapshot struct {
+	Generation uint64
+	Sid        SID
+	Monitored  shA256 // Of the monitored filenames
+	Ignored    shA256 // Of the ignore patterns and their kinds
+}
+
+// Returns the events that take the given snapshot to this one.
+func (me watchSnapshot) eventsSince(old watchSnapshot) []WatchEvent {
+	events := make([]WatchEvent, 0, 1)
+	add := func(kind WatchKind) {
+		events = append(events, WatchEvent{Kind: kind,
+			Generation: me.Generation, Sid: me.Sid})
+	}
+	if me.Monitored != old.Monitored {
+		add(WatchMonitor)
+	}
+	if me.Ignored != old.Ignored {
+		add(WatchIgnore)
+	}
+	if me.Sid > old.Sid {
+		add(WatchSave)
+	}
+	if len(events) == 0 && me.Generation != old.Generation {
+		add(WatchOther)
+	}
+	return events
+}
+
+func getGeneration(tx *bolt.Tx) uint64 {
+	if config := tx.Bucket(configBucket); config != nil {
+		if raw := config.Get(configGeneration); len(raw) == 8 {
+			return binary.BigEndian.Uint64(raw)
+		}
+	}
+	return 0
+}
+
+// Every transaction that changes the .fhd file calls this.
+func bumpGeneration(tx *bolt.Tx) error {
+	config := tx.Bucket(configBucket)
+	if config == nil {
+		return fmt.Errorf("failed to find %q", configBucket)
+	}
+	return config.Put(configGeneration, binary.BigEndian.AppendUint64(nil,
+		getGeneration(tx)+1))
+}
+
+func (me *Fhd) watchSnapshot() (watchSnapshot, error) {
+	var snapshot watchSnapshot
+	err := me.view(func(tx *bolt.Tx) error {
+		snapshot.Generation = getGeneration(tx)
+		saves := tx.Bucket(savesBucket)
+		if saves == nil {
+			return fmt.Errorf("failed to find %q", savesBucket)
+		}
+		if rawSid, _ := saves.Cursor().Last(); rawSid != nil {
+			snapshot.Sid = unmarshalSid(rawSid)
+		}
+		states := tx.Bucket(statesBucket)
+		if states == nil {
+			return fmt.Errorf("failed to find %q", statesBucket)
+		}
+		hasher := sha256.New()
+		_ = states.ForEach(func(rawFilename, rawStateVal []byte) error {
+			if unmarshalStateVal(rawStateVal).Monitored {
+				hasher.Write(rawFilename)
+				hasher.Write([]byte{0})
+			}
+			return nil
+		})
+		snapshot.Monitored = shA256(hasher.Sum(nil))
+		config := tx.Bucket(configBucket)
+		if config == nil {
+			return fmt.Errorf("failed to find %q", configBucket)
+		}
+		hasher.Reset()
+		if ignore := config.Bucket(configIgnore); ignore != nil {
+			_ = ignore.ForEach(func(rawPattern,
+				rawIgnoreKind []byte) error {
+				hasher.Write(rawPattern)
+				hasher.Write([]byte{0})
+				hasher.Write(rawIgnoreKind)
+				return nil
+			})
+		}
+		snapshot.Ignored = shA256(hasher.Sum(nil))
+		return nil
+	})
+	return snapshot, err
+}
+
+// Generation returns a number that every change to the .fhd file
+// increases.
+func (me *Fhd) Generation() (uint64, error) {
+	var generation uint64
+	err := me.view(func(tx *bolt.Tx) error {
+		generation = getGeneration(tx)
+		return nil
+	})
+	return generation, err
+}
+
+// Watch returns a channel that receives an event for each new save,
+// monitor change, ignore change, or other change to the .fhd file until
+// the context is done, when the channel is closed. It works by polling the
+// .fhd file's modification time and generation, so an event may arrive
+// up to half a second after its change.
+func (me *Fhd) Watch(ctx context.Context) (<-chan WatchEvent, error) {
+	return watch(ctx, me.Filename(), me.watchSnapshot)
+}
+
+func watch(ctx context.Context, filename string,
+	snapshotFn func() (watchSnapshot, error)) (<-chan WatchEvent, error) {
+	snapshot, err := snapshotFn()
+	if err != nil {
+		return nil, err
+	}
+	info, _ := os.Stat(filename)
+	events := make(chan WatchEvent, 16)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			newInfo, err := os.Stat(filename)
+			if err == nil && info != nil &&
+				newInfo.ModTime().Equal(info.ModTime()) &&
+				newInfo.Size() == info.Size() &&
+				time.Since(info.ModTime()) > racyInterval {
+				continue // Nothing can have changed
+			}
+			info = newInfo
+			newSnapshot, err := snapshotFn()
+			if err != nil || newSnapshot.Generation == snapshot.Generation {
+				continue
+			}
+			for _, event := range newSnapshot.eventsSince(snapshot) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			snapshot = newSnapshot
+		}
+	}()
+	return events, nil
+}